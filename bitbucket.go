@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// bitbucketProvider handles pushes from Bitbucket Cloud (repo:push) and
+// Bitbucket Server/Data Center (repo:refs_changed). Both sign the body with
+// the webhook secret in X-Hub-Signature, sha256= included.
+type bitbucketProvider struct{}
+
+// bitbucketPayload covers the push payloads of Bitbucket Cloud and Server
+type bitbucketPayload struct {
+	// Cloud
+	Push struct {
+		Changes []struct {
+			New *struct {
+				Type   string `json:"type"` // branch, named_branch, bookmark or tag
+				Name   string `json:"name"`
+				Target struct {
+					Hash    string `json:"hash"`
+					Message string `json:"message"`
+					Links   struct {
+						HTML struct {
+							Href string `json:"href"`
+						} `json:"html"`
+					} `json:"links"`
+				} `json:"target"`
+			} `json:"new"` // null when the branch or tag was deleted
+		} `json:"changes"`
+	} `json:"push"`
+	Actor struct {
+		DisplayName string `json:"display_name"` // Cloud
+		Nickname    string `json:"nickname"`
+		Name        string `json:"name"` // Server
+		Display     string `json:"displayName"`
+		Email       string `json:"emailAddress"`
+	} `json:"actor"`
+	Repository struct {
+		FullName string `json:"full_name"` // Cloud: workspace/repo
+		Name     string `json:"name"`
+		Slug     string `json:"slug"` // Server
+		Project  struct {
+			Key string `json:"key"`
+		} `json:"project"`
+		Links struct {
+			HTML struct {
+				Href string `json:"href"` // Cloud
+			} `json:"html"`
+		} `json:"links"`
+	} `json:"repository"`
+
+	// Server
+	Changes []struct {
+		Ref struct {
+			ID string `json:"id"` // e.g. refs/heads/main
+		} `json:"ref"`
+		ToHash string `json:"toHash"`
+		Type   string `json:"type"` // ADD, UPDATE or DELETE
+	} `json:"changes"`
+}
+
+func (bitbucketProvider) name() string { return "bitbucket" }
+
+func (bitbucketProvider) match(r *http.Request, body []byte) bool {
+	return r.Header.Get("X-Event-Key") != ""
+}
+
+func (bitbucketProvider) authenticate(r *http.Request, body []byte, config *Config) error {
+	signature := r.Header.Get("X-Hub-Signature")
+	if signature == "" {
+		return errors.New("no X-Hub-Signature header, set a secret on the Bitbucket webhook")
+	}
+	if !checkSignature(body, signature, config.BitbucketSecret) {
+		return errInvalidSignature
+	}
+	return nil
+}
+
+func (p bitbucketProvider) parse(r *http.Request, body []byte) (deployEvent, error) {
+	var payload bitbucketPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return deployEvent{}, fmt.Errorf("invalid JSON payload: %w", err)
+	}
+	event := deployEvent{
+		Provider:   p.name(),
+		Type:       "push",
+		DeliveryID: firstNonEmpty(r.Header.Get("X-Request-UUID"), r.Header.Get("X-Request-Id")),
+	}
+	repo := payload.Repository
+	out := &event.Payload
+
+	// A push may change several refs; every one that still exists is a
+	// candidate, and routeRef picks the one the repository's filters allow
+	switch eventType := r.Header.Get("X-Event-Key"); eventType {
+	case "repo:push":
+		event.Repository = repo.FullName
+		event.Author = firstNonEmpty(payload.Actor.DisplayName, payload.Actor.Nickname)
+		for _, change := range payload.Push.Changes {
+			if change.New == nil || change.New.Target.Hash == "" {
+				continue
+			}
+			ref := pushedRef{
+				Ref:     "refs/heads/" + change.New.Name,
+				Commit:  change.New.Target.Hash,
+				Message: change.New.Target.Message,
+				URL:     change.New.Target.Links.HTML.Href,
+			}
+			if change.New.Type == "tag" {
+				ref.Ref = "refs/tags/" + change.New.Name
+			}
+			event.Refs = append(event.Refs, ref)
+		}
+		out.Repository.HTMLURL = repo.Links.HTML.Href
+	case "repo:refs_changed":
+		if repo.Project.Key != "" && repo.Slug != "" {
+			event.Repository = repo.Project.Key + "/" + repo.Slug
+		}
+		event.Author = firstNonEmpty(payload.Actor.Display, payload.Actor.Name)
+		out.Pusher.Email = payload.Actor.Email
+		for _, change := range payload.Changes {
+			if change.Type == "DELETE" || change.ToHash == "" {
+				continue
+			}
+			event.Refs = append(event.Refs, pushedRef{Ref: change.Ref.ID, Commit: change.ToHash})
+		}
+	case "diagnostics:ping":
+		return event, ignoreEvent("Ping received, the webhook is set up")
+	default:
+		return event, ignoreEvent(fmt.Sprintf("Unsupported Bitbucket event %q", eventType))
+	}
+
+	if event.Repository == "" {
+		return event, errors.New("payload names no repository")
+	}
+	if len(event.Refs) == 0 {
+		return event, ignoreEvent("Push deleted its refs, nothing to deploy")
+	}
+	event.useRef(event.Refs[0])
+	out.Repository.Name = firstNonEmpty(repo.Slug, event.Repository[strings.LastIndex(event.Repository, "/")+1:])
+	out.Repository.FullName = event.Repository
+	out.Pusher.Name = event.Author
+	return event, nil
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Trimmed from a Bitbucket Cloud repo:push webhook
+const bitbucketCloudPush = `{
+  "push": {
+    "changes": [
+      {
+        "old": {"type": "branch", "name": "main", "target": {"hash": "1e65c05c1d5171631d92438a13901ca7dae9618c"}},
+        "new": {
+          "type": "branch",
+          "name": "main",
+          "target": {
+            "type": "commit",
+            "hash": "709d658dc5b6d6afcd46049c2f332ee3f515a67d",
+            "message": "Fix the login redirect\n",
+            "links": {"html": {"href": "https://bitbucket.org/acme/shop-api/commits/709d658dc5b6d6afcd46049c2f332ee3f515a67d"}}
+          }
+        },
+        "created": false,
+        "forced": false,
+        "closed": false
+      }
+    ]
+  },
+  "actor": {"type": "user", "display_name": "Emma Doe", "nickname": "emma", "account_id": "557058:c0b7a1f5"},
+  "repository": {
+    "type": "repository",
+    "full_name": "acme/shop-api",
+    "name": "shop-api",
+    "links": {"html": {"href": "https://bitbucket.org/acme/shop-api"}},
+    "is_private": true
+  }
+}`
+
+// Trimmed from a Bitbucket Server 8 repo:refs_changed webhook
+const bitbucketServerPush = `{
+  "eventKey": "repo:refs_changed",
+  "date": "2024-03-05T10:21:47+0000",
+  "actor": {"name": "admin", "emailAddress": "admin@example.com", "id": 1, "displayName": "Administrator", "slug": "admin", "type": "NORMAL"},
+  "repository": {
+    "slug": "shop-api",
+    "id": 84,
+    "name": "Shop API",
+    "project": {"key": "ACME", "id": 84, "name": "Acme", "type": "NORMAL"}
+  },
+  "changes": [
+    {
+      "ref": {"id": "refs/heads/main", "displayId": "main", "type": "BRANCH"},
+      "refId": "refs/heads/main",
+      "fromHash": "ecddabb624f6f5ba43816f5926e580a5f680a932",
+      "toHash": "178864a7d521b6f5e720b386b2c2b0ef8563e0dc",
+      "type": "UPDATE"
+    }
+  ]
+}`
+
+// bitbucketCloudChanges builds a Cloud push changing the given refs, a
+// "tag:" prefix pushing a tag and a "-" prefix deleting the ref
+func bitbucketCloudChanges(refs ...string) string {
+	var changes []string
+	for i, ref := range refs {
+		if name, ok := strings.CutPrefix(ref, "-"); ok {
+			changes = append(changes, fmt.Sprintf(`{"old":{"type":"branch","name":%q},"new":null,"closed":true}`, name))
+			continue
+		}
+		kind, name := "branch", ref
+		if tag, ok := strings.CutPrefix(ref, "tag:"); ok {
+			kind, name = "tag", tag
+		}
+		changes = append(changes, fmt.Sprintf(`{"new":{"type":%q,"name":%q,"target":{"hash":"%040d","message":"commit %d"}}}`, kind, name, i+1, i+1))
+	}
+	return `{"push":{"changes":[` + strings.Join(changes, ",") + `]},"actor":{"display_name":"Emma Doe"},
+"repository":{"full_name":"acme/shop-api","name":"shop-api"}}`
+}
+
+// bitbucketServerChanges builds a Server refs_changed event the same way
+func bitbucketServerChanges(refs ...string) string {
+	var changes []string
+	for i, ref := range refs {
+		kind := "UPDATE"
+		if name, ok := strings.CutPrefix(ref, "-"); ok {
+			kind, ref = "DELETE", name
+		}
+		id := "refs/heads/" + ref
+		if tag, ok := strings.CutPrefix(ref, "tag:"); ok {
+			id = "refs/tags/" + tag
+		}
+		toHash := fmt.Sprintf("%040d", i+1)
+		if kind == "DELETE" {
+			toHash = nullSHA
+		}
+		changes = append(changes, fmt.Sprintf(`{"ref":{"id":%q},"toHash":%q,"type":%q}`, id, toHash, kind))
+	}
+	return `{"actor":{"name":"admin"},"repository":{"slug":"shop-api","project":{"key":"ACME"}},"changes":[` +
+		strings.Join(changes, ",") + `]}`
+}
+
+func TestBitbucketAuthenticate(t *testing.T) {
+	cfg := loadTestConfig(t, "server: {secret: webhook-secret, bitbucket_secret: bitbucket-secret}\n")
+	tests := []struct {
+		name   string
+		body   string
+		header []string
+		ok     bool
+	}{
+		{"cloud", bitbucketCloudPush, []string{"X-Event-Key: repo:push", "X-Hub-Signature: sha256=" + hmacHex("bitbucket-secret", bitbucketCloudPush)}, true},
+		{"server", bitbucketServerPush, []string{"X-Event-Key: repo:refs_changed", "X-Hub-Signature: sha256=" + hmacHex("bitbucket-secret", bitbucketServerPush)}, true},
+		{"cloud wrong secret", bitbucketCloudPush, []string{"X-Event-Key: repo:push", "X-Hub-Signature: sha256=" + hmacHex("wrong", bitbucketCloudPush)}, false},
+		{"server wrong secret", bitbucketServerPush, []string{"X-Event-Key: repo:refs_changed", "X-Hub-Signature: sha256=" + hmacHex("wrong", bitbucketServerPush)}, false},
+		{"server secret", bitbucketCloudPush, []string{"X-Event-Key: repo:push", "X-Hub-Signature: sha256=" + hmacHex("webhook-secret", bitbucketCloudPush)}, false},
+		{"signature of another body", bitbucketServerPush, []string{"X-Event-Key: repo:refs_changed", "X-Hub-Signature: sha256=" + hmacHex("bitbucket-secret", bitbucketCloudPush)}, false},
+		{"cloud missing signature", bitbucketCloudPush, []string{"X-Event-Key: repo:push"}, false},
+		{"server missing signature", bitbucketServerPush, []string{"X-Event-Key: repo:refs_changed"}, false},
+	}
+	for _, tt := range tests {
+		r := newWebhook(tt.body, tt.header...)
+		err := bitbucketProvider{}.authenticate(r, []byte(tt.body), cfg)
+		if tt.ok && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if !tt.ok && err == nil {
+			t.Errorf("%s: accepted", tt.name)
+		}
+	}
+
+	// Without bitbucket_secret the server secret signs Bitbucket webhooks
+	cfg = loadTestConfig(t, "server: {secret: webhook-secret}\n")
+	r := newWebhook(bitbucketServerPush, "X-Event-Key: repo:refs_changed", "X-Hub-Signature: sha256="+hmacHex("webhook-secret", bitbucketServerPush))
+	if err := (bitbucketProvider{}).authenticate(r, []byte(bitbucketServerPush), cfg); err != nil {
+		t.Errorf("server secret fallback: %v", err)
+	}
+}
+
+func TestBitbucketParse(t *testing.T) {
+	cfg := loadTestConfig(t, "server: {secret: s}\n")
+	tests := []struct {
+		name     string
+		header   []string
+		body     string
+		repo     string
+		ref      string
+		commit   string
+		author   string
+		message  string
+		url      string
+		delivery string
+	}{
+		{
+			name:     "cloud push",
+			header:   []string{"X-Event-Key: repo:push", "X-Request-UUID: 2c7e3a1b-5d4f-4b8e-9a6c-1f0e2d3c4b5a"},
+			body:     bitbucketCloudPush,
+			repo:     "acme/shop-api",
+			ref:      "refs/heads/main",
+			commit:   "709d658dc5b6d6afcd46049c2f332ee3f515a67d",
+			author:   "Emma Doe",
+			message:  "Fix the login redirect\n",
+			url:      "https://bitbucket.org/acme/shop-api/commits/709d658dc5b6d6afcd46049c2f332ee3f515a67d",
+			delivery: "2c7e3a1b-5d4f-4b8e-9a6c-1f0e2d3c4b5a",
+		},
+		{
+			name:     "server push",
+			header:   []string{"X-Event-Key: repo:refs_changed", "X-Request-Id: 7b1f8c2e-3d4a-4e5b-8f6c-9a0b1c2d3e4f"},
+			body:     bitbucketServerPush,
+			repo:     "ACME/shop-api",
+			ref:      "refs/heads/main",
+			commit:   "178864a7d521b6f5e720b386b2c2b0ef8563e0dc",
+			author:   "Administrator",
+			delivery: "7b1f8c2e-3d4a-4e5b-8f6c-9a0b1c2d3e4f",
+		},
+		{
+			name:    "cloud tag",
+			header:  []string{"X-Event-Key: repo:push"},
+			body:    bitbucketCloudChanges("tag:v2.0.0"),
+			repo:    "acme/shop-api",
+			ref:     "refs/tags/v2.0.0",
+			commit:  fmt.Sprintf("%040d", 1),
+			author:  "Emma Doe",
+			message: "commit 1",
+		},
+		{
+			name:   "server tag",
+			header: []string{"X-Event-Key: repo:refs_changed"},
+			body:   bitbucketServerChanges("tag:v2.0.0"),
+			repo:   "ACME/shop-api",
+			ref:    "refs/tags/v2.0.0",
+			commit: fmt.Sprintf("%040d", 1),
+			author: "admin",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event, err := parseWebhook(t, cfg, "bitbucket", newWebhook(tt.body, tt.header...), tt.body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if event.Repository != tt.repo || event.Ref != tt.ref || event.Commit != tt.commit || event.Author != tt.author {
+				t.Errorf("event = %s %s %s by %s, want %s %s %s by %s",
+					event.Repository, event.Ref, event.Commit, event.Author, tt.repo, tt.ref, tt.commit, tt.author)
+			}
+			if event.DeliveryID != tt.delivery {
+				t.Errorf("delivery = %q, want %q", event.DeliveryID, tt.delivery)
+			}
+			p := event.Payload
+			if p.Repository.FullName != tt.repo || p.Repository.Name != "shop-api" || p.Ref != tt.ref || p.HeadCommit.ID != tt.commit {
+				t.Errorf("payload = %s %s %s %s", p.Repository.FullName, p.Repository.Name, p.Ref, p.HeadCommit.ID)
+			}
+			if p.HeadCommit.Message != tt.message || p.HeadCommit.URL != tt.url {
+				t.Errorf("head commit = %q %s, want %q %s", p.HeadCommit.Message, p.HeadCommit.URL, tt.message, tt.url)
+			}
+		})
+	}
+}
+
+// A push of several refs deploys the first one the repository's filters
+// allow, whichever order Bitbucket lists them in
+func TestBitbucketMultipleChanges(t *testing.T) {
+	filtered := `
+server: {secret: s}
+repos:
+  acme/shop-api: {branches: [main], tags: ["v*"]}
+`
+	tests := []struct {
+		name     string
+		pipeline string
+		refs     []string
+		want     string
+		commit   int // position of the deployed change, from 1
+	}{
+		{"allowed branch first", filtered, []string{"main", "feature/x"}, "refs/heads/main", 1},
+		{"allowed branch last", filtered, []string{"feature/x", "main"}, "refs/heads/main", 2},
+		{"allowed tag", filtered, []string{"feature/x", "tag:v2.0.0"}, "refs/tags/v2.0.0", 2},
+		{"deleted branch skipped", filtered, []string{"-feature/x", "feature/y", "main"}, "refs/heads/main", 3},
+		{"nothing allowed", filtered, []string{"feature/x", "feature/y"}, "refs/heads/feature/x", 1},
+		{"no filters", "server: {secret: s}\n", []string{"feature/x", "main"}, "refs/heads/feature/x", 1},
+	}
+	for _, tt := range tests {
+		cfg := loadTestConfig(t, tt.pipeline)
+		for _, server := range []bool{false, true} {
+			body, header := bitbucketCloudChanges(tt.refs...), "X-Event-Key: repo:push"
+			if server {
+				body, header = bitbucketServerChanges(tt.refs...), "X-Event-Key: repo:refs_changed"
+			}
+			t.Run(fmt.Sprintf("%s/server=%t", tt.name, server), func(t *testing.T) {
+				event, err := parseWebhook(t, cfg, "bitbucket", newWebhook(body, header), body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				commit := fmt.Sprintf("%040d", tt.commit)
+				if event.Ref != tt.want || event.Commit != commit {
+					t.Errorf("deployed %s %s, want %s %s", event.Ref, event.Commit, tt.want, commit)
+				}
+				if event.Payload.Ref != event.Ref || event.Payload.HeadCommit.ID != event.Commit {
+					t.Errorf("payload = %s %s", event.Payload.Ref, event.Payload.HeadCommit.ID)
+				}
+			})
+		}
+	}
+}
+
+func TestBitbucketIgnored(t *testing.T) {
+	cfg := loadTestConfig(t, "server: {secret: s}\n")
+	tests := []struct {
+		name  string
+		event string
+		body  string
+	}{
+		{"cloud deletion", "repo:push", bitbucketCloudChanges("-feature/x")},
+		{"server deletion", "repo:refs_changed", bitbucketServerChanges("-feature/x", "-feature/y")},
+		{"ping", "diagnostics:ping", `{"test":true}`},
+		{"pull request", "pullrequest:created", `{"repository":{"full_name":"acme/shop-api"}}`},
+	}
+	for _, tt := range tests {
+		_, err := parseWebhook(t, cfg, "bitbucket", newWebhook(tt.body, "X-Event-Key: "+tt.event), tt.body)
+		t.Run(tt.name, func(t *testing.T) { wantIgnored(t, err) })
+	}
+
+	body := `{"changes":[{"ref":{"id":"refs/heads/main"},"toHash":"178864a7","type":"UPDATE"}],"repository":{"slug":"shop-api"}}`
+	if _, err := parseWebhook(t, cfg, "bitbucket", newWebhook(body, "X-Event-Key: repo:refs_changed"), body); err == nil {
+		t.Error("push without a project key was accepted")
+	}
+}
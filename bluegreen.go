@@ -0,0 +1,642 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Deployment strategies of an environment
+const (
+	strategyRecreate  = "recreate"   // stop the old container, then run the new one
+	strategyBlueGreen = "blue_green" // run the new container next to the old one, switch once it is healthy
+)
+
+// How blue/green deployments move traffic to the new container
+const (
+	switchProxy = "proxy" // the deployer listens on the service port and forwards to the live container
+	switchAlias = "alias" // the live container answers to the service name on a Docker network
+)
+
+// Labels put on the containers of blue/green services
+const (
+	serviceLabel = "webhook-deploy.service"
+	colorLabel   = "webhook-deploy.color"
+)
+
+// Store bucket of the live container per blue/green service
+const blueGreenBucket = "blue_green"
+
+// BlueGreenConfig configures the blue_green strategy of an environment
+type BlueGreenConfig struct {
+	Switch string      `yaml:"switch"` // "proxy" (default) or "alias"
+	Health HealthCheck `yaml:"health"`
+}
+
+// HealthCheck decides when a new container may take traffic. With a path the
+// container is probed over HTTP, otherwise the image's HEALTHCHECK is used.
+type HealthCheck struct {
+	Path     string        `yaml:"path"`     // e.g. /health; any 2xx response is healthy
+	Port     int           `yaml:"port"`     // container port of the probe, default the service port
+	Timeout  time.Duration `yaml:"timeout"`  // default 2m
+	Interval time.Duration `yaml:"interval"` // default 2s
+}
+
+func (b BlueGreenConfig) merge(over BlueGreenConfig) BlueGreenConfig {
+	b.Switch = firstNonEmpty(over.Switch, b.Switch)
+	b.Health.Path = firstNonEmpty(over.Health.Path, b.Health.Path)
+	if over.Health.Port != 0 {
+		b.Health.Port = over.Health.Port
+	}
+	if over.Health.Timeout != 0 {
+		b.Health.Timeout = over.Health.Timeout
+	}
+	if over.Health.Interval != 0 {
+		b.Health.Interval = over.Health.Interval
+	}
+	return b
+}
+
+// validate reports the mistakes in a (possibly partial) blue_green section
+func (b BlueGreenConfig) validate(where string) []error {
+	var errs []error
+	if b.Switch != "" && b.Switch != switchProxy && b.Switch != switchAlias {
+		errs = append(errs, fmt.Errorf("%s.switch: %q is not proxy or alias", where, b.Switch))
+	}
+	if b.Health.Path != "" && !strings.HasPrefix(b.Health.Path, "/") {
+		errs = append(errs, fmt.Errorf("%s.health.path: %q must start with /", where, b.Health.Path))
+	}
+	if b.Health.Port < 0 || b.Health.Port > 65535 {
+		errs = append(errs, fmt.Errorf("%s.health.port: %d is not a port", where, b.Health.Port))
+	}
+	if b.Health.Timeout < 0 || b.Health.Interval < 0 {
+		errs = append(errs, fmt.Errorf("%s.health: timeout and interval must not be negative", where))
+	}
+	return errs
+}
+
+// blueGreenService is the resolved blue/green setup of one container. The
+// service keeps the name the recreate strategy gives the container; its two
+// colors run as <name>-blue and <name>-green.
+type blueGreenService struct {
+	Name    string
+	Switch  string
+	Listen  string // proxy: address the deployer accepts traffic on
+	Port    int    // container port traffic goes to
+	Network string
+	Health  HealthCheck
+	spec    ContainerSpec // spec of the color containers, without a name
+}
+
+func newBlueGreenService(spec ContainerSpec, cfg BlueGreenConfig) (blueGreenService, error) {
+	s := blueGreenService{
+		Name:    spec.Name,
+		Switch:  firstNonEmpty(cfg.Switch, switchProxy),
+		Network: spec.Network,
+		Health:  cfg.Health,
+	}
+
+	switch s.Switch {
+	case switchProxy:
+		// Both colors run at once, so neither can publish the service port;
+		// the proxy takes it over and reaches the containers by IP
+		if len(spec.Ports) != 1 {
+			return s, fmt.Errorf("blue_green with switch proxy needs exactly one port mapping for the proxy to serve, not %d", len(spec.Ports))
+		}
+		listen, port, err := proxyPort(spec.Ports[0])
+		if err != nil {
+			return s, err
+		}
+		s.Listen, s.Port = listen, port
+	case switchAlias:
+		if len(spec.Ports) > 0 {
+			return s, fmt.Errorf("blue_green with switch alias cannot publish ports, traffic reaches the container through the network alias %s", s.Name)
+		}
+		if s.Network == "" || s.Network == "bridge" || s.Network == "host" || s.Network == "none" {
+			return s, fmt.Errorf("blue_green with switch alias needs container.network set to a user-defined network")
+		}
+		if s.Health.Path != "" && s.Health.Port == 0 {
+			return s, fmt.Errorf("blue_green.health.port is required with switch alias")
+		}
+	default:
+		return s, fmt.Errorf("blue_green.switch: %q is not proxy or alias", s.Switch)
+	}
+
+	if s.Health.Port == 0 {
+		s.Health.Port = s.Port
+	}
+	if s.Health.Timeout == 0 {
+		s.Health.Timeout = 2 * time.Minute
+	}
+	if s.Health.Interval == 0 {
+		s.Health.Interval = 2 * time.Second
+	}
+	spec.Ports = nil
+	spec.Labels = mergeMaps(spec.Labels, map[string]string{serviceLabel: s.Name})
+	s.spec = spec
+	return s, nil
+}
+
+// proxyPort splits a [ip:]host:container[/tcp] mapping into the address the
+// proxy listens on and the container port it forwards to
+func proxyPort(mapping string) (string, int, error) {
+	rest, proto, _ := strings.Cut(mapping, "/")
+	if proto != "" && proto != "tcp" {
+		return "", 0, fmt.Errorf("port %q: the proxy only forwards tcp", mapping)
+	}
+	i := strings.LastIndexByte(rest, ':')
+	if i < 0 {
+		return "", 0, fmt.Errorf("port %q has no host port for the proxy to listen on", mapping)
+	}
+	listen := rest[:i]
+	port, err := strconv.Atoi(rest[i+1:])
+	if err != nil {
+		return "", 0, fmt.Errorf("port %q: the proxy forwards a single port, not a range", mapping)
+	}
+	if !strings.Contains(listen, ":") {
+		listen = ":" + listen
+	}
+	if _, hostPort, err := net.SplitHostPort(listen); err != nil {
+		return "", 0, fmt.Errorf("port %q: %w", mapping, err)
+	} else if _, err := strconv.Atoi(hostPort); err != nil {
+		return "", 0, fmt.Errorf("port %q: the proxy forwards a single port, not a range", mapping)
+	}
+	return listen, port, nil
+}
+
+// colors returns the names of the two containers of the service
+func (s blueGreenService) colors() (blue, green string) {
+	return s.Name + "-blue", s.Name + "-green"
+}
+
+// current finds the containers serving the service now: the recorded live
+// color (or else a running one) and a container left by the recreate
+// strategy, which is named like the service itself
+func (s blueGreenService) current(ctx context.Context, c *dockerClient) (live string, previous []string, err error) {
+	if rec, ok := traffic.live(s.Name); ok {
+		live = rec.Container
+	}
+	blue, green := s.colors()
+	if live == "" {
+		for _, name := range []string{blue, green} {
+			container, err := c.inspectContainer(ctx, name)
+			if err != nil && !isDockerNotFound(err) {
+				return "", nil, err
+			}
+			if err == nil && container.State.Running {
+				live = name
+				break
+			}
+		}
+	}
+	if live != "" {
+		previous = append(previous, live)
+	}
+	if _, err := c.inspectContainer(ctx, s.Name); err == nil {
+		previous = append(previous, s.Name)
+	} else if !isDockerNotFound(err) {
+		return "", nil, err
+	}
+	return live, previous, nil
+}
+
+// liveName returns the container serving the service, for steps that run
+// after the switch
+func (s blueGreenService) liveName() string {
+	if rec, ok := traffic.live(s.Name); ok {
+		return rec.Container
+	}
+	return s.Name
+}
+
+// waitHealthy polls the container until its probe passes. It fails early
+// when the container stops running or its HEALTHCHECK reports unhealthy.
+func (s blueGreenService) waitHealthy(ctx context.Context, c *dockerClient, name string, out io.Writer) error {
+	ctx, cancel := context.WithTimeout(ctx, s.Health.Timeout)
+	defer cancel()
+	ticker := time.NewTicker(s.Health.Interval)
+	defer ticker.Stop()
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	last := ""
+	for {
+		ok, detail, err := s.probe(ctx, c, client, name)
+		if err != nil && ctx.Err() == nil {
+			return err
+		}
+		if ok {
+			fmt.Fprintf(out, "%s is healthy (%s)\n", name, detail)
+			return nil
+		}
+		if err == nil && detail != last {
+			fmt.Fprintf(out, "Waiting for %s: %s\n", name, detail)
+			last = detail
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s did not become healthy within %v (last: %s)", name, s.Health.Timeout, firstNonEmpty(last, "no answer"))
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe checks the container once. It returns an error only when waiting
+// longer cannot help.
+func (s blueGreenService) probe(ctx context.Context, c *dockerClient, client *http.Client, name string) (bool, string, error) {
+	container, err := c.inspectContainer(ctx, name)
+	if err != nil {
+		return false, "", err
+	}
+	state := container.State
+	if !state.Running || state.Restarting {
+		reason := fmt.Sprintf("exit code %d", state.ExitCode)
+		if state.OOMKilled {
+			reason += ", out of memory"
+		}
+		return false, "", fmt.Errorf("%s is %s (%s)", name, state.Status, reason)
+	}
+
+	if s.Health.Path == "" {
+		if state.Health == nil {
+			return false, "", fmt.Errorf("the image of %s has no HEALTHCHECK, set blue_green.health.path to probe it over HTTP", name)
+		}
+		switch state.Health.Status {
+		case "healthy":
+			return true, "HEALTHCHECK healthy", nil
+		case "unhealthy":
+			return false, "", fmt.Errorf("%s is unhealthy according to its HEALTHCHECK", name)
+		}
+		return false, "HEALTHCHECK " + state.Health.Status, nil
+	}
+
+	target := "http://" + net.JoinHostPort(container.address(s.Network), strconv.Itoa(s.Health.Port)) + s.Health.Path
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return false, "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err.Error(), nil
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+	detail := fmt.Sprintf("GET %s: %s", target, resp.Status)
+	return resp.StatusCode >= 200 && resp.StatusCode < 300, detail, nil
+}
+
+// blueGreenSteps deploys image next to the live container of the service
+// and switches traffic only once the new container is healthy. Until then
+// the live container is not touched, so a failed deployment keeps it serving.
+func blueGreenSteps(host string, image imageRef, s blueGreenService) []Step {
+	var live, next string // live color before the deployment, color being deployed
+	var previous []string // containers to retire after the switch
+
+	start := func(ctx context.Context, out io.Writer, run *deployRun) error {
+		c, err := dockerClientFor(host)
+		if err != nil {
+			return err
+		}
+		if live, previous, err = s.current(ctx, c); err != nil {
+			return err
+		}
+		blue, green := s.colors()
+		next = blue
+		if live == blue {
+			next = green
+		}
+
+		// What is left of a failed deployment, stopped for inspection
+		if err := c.removeContainer(ctx, next); err == nil {
+			fmt.Fprintf(out, "Removed %s left over from an earlier deployment\n", next)
+		} else if !isDockerNotFound(err) {
+			return err
+		}
+
+		spec := s.spec
+		spec.Name = next
+		spec.Labels = mergeMaps(spec.Labels, map[string]string{colorLabel: strings.TrimPrefix(next, s.Name+"-")})
+		body, err := spec.createBody(image.String())
+		if err != nil {
+			return err
+		}
+		id, err := c.createContainer(ctx, next, body)
+		if err != nil {
+			return err
+		}
+		if err := c.startContainer(ctx, id); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Started %s (%s), live: %s\n", next, shortID(id), firstNonEmpty(live, "none"))
+		return nil
+	}
+
+	healthy := func(ctx context.Context, out io.Writer, run *deployRun) error {
+		c, err := dockerClientFor(host)
+		if err != nil {
+			return err
+		}
+		err = s.waitHealthy(ctx, c, next, out)
+		if err == nil {
+			return nil
+		}
+
+		// The step context may be what ran out
+		stopCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if stopErr := c.stopContainer(stopCtx, next); stopErr != nil {
+			fmt.Fprintf(out, "Warning: %v\n", stopErr)
+		}
+		if live != "" {
+			fmt.Fprintf(out, "Stopped %s, %s keeps serving\n", next, live)
+		} else {
+			fmt.Fprintf(out, "Stopped %s\n", next)
+		}
+		return err
+	}
+
+	cutover := func(ctx context.Context, out io.Writer, run *deployRun) error {
+		c, err := dockerClientFor(host)
+		if err != nil {
+			return err
+		}
+		if traffic == nil {
+			return errors.New("blue/green deployments only run inside the server")
+		}
+		rec := liveContainer{
+			Service:    s.Name,
+			Container:  next,
+			Switch:     s.Switch,
+			Listen:     s.Listen,
+			Port:       s.Port,
+			Network:    s.Network,
+			DockerHost: host,
+			SwitchedAt: time.Now().UTC(),
+		}
+
+		switch s.Switch {
+		case switchAlias:
+			// Aliases are set when a container joins a network, so rejoin.
+			// The previous containers keep the alias until they are stopped,
+			// which lets them finish the requests they are serving.
+			if err := c.disconnectNetwork(ctx, s.Network, next); err != nil {
+				return err
+			}
+			if err := c.connectNetwork(ctx, s.Network, next, []string{s.Name}); err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "%s answers as %s on network %s\n", next, s.Name, s.Network)
+		case switchProxy:
+			addr, err := rec.resolve(ctx)
+			if err != nil {
+				return err
+			}
+			err = traffic.route(rec, addr)
+			if err != nil && containsString(previous, s.Name) {
+				// A container of the recreate strategy still publishes the port
+				fmt.Fprintf(out, "Stopping %s to free %s for the proxy\n", s.Name, s.Listen)
+				if err := c.stopContainer(ctx, s.Name); err != nil {
+					return err
+				}
+				err = traffic.route(rec, addr)
+			}
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "Proxy %s forwards to %s (%s)\n", s.Listen, next, addr)
+		}
+		return traffic.record(rec)
+	}
+
+	retire := func(ctx context.Context, out io.Writer, run *deployRun) error {
+		c, err := dockerClientFor(host)
+		if err != nil {
+			return err
+		}
+		if len(previous) == 0 {
+			fmt.Fprintln(out, "No previous container")
+			return errNothingToDo
+		}
+		for _, old := range previous {
+			if err := c.stopContainer(ctx, old); err != nil && !isDockerNotFound(err) {
+				return err
+			}
+			if err := c.removeContainer(ctx, old); err != nil && !isDockerNotFound(err) {
+				return err
+			}
+			fmt.Fprintf(out, "Removed %s\n", old)
+		}
+		return nil
+	}
+
+	// The color is only known at run time
+	placeholder := s.Name + "-<color>"
+	spec := s.spec
+	spec.Name = placeholder
+	runCommand, _ := spec.runCommand(image.String())
+	runCommand = strings.Replace(runCommand, shellQuote(placeholder), placeholder, 1)
+
+	probe := "HEALTHCHECK"
+	if s.Health.Path != "" {
+		probe = fmt.Sprintf("GET :%d%s", s.Health.Port, s.Health.Path)
+	}
+	target := fmt.Sprintf("proxy %s -> port %d", s.Listen, s.Port)
+	if s.Switch == switchAlias {
+		target = fmt.Sprintf("alias %s on network %s", s.Name, s.Network)
+	}
+
+	return []Step{
+		pullStep(host, image),
+		{Run: runCommand, call: start},
+		{Run: fmt.Sprintf("wait until %s is healthy (%s, up to %v)", placeholder, probe, s.Health.Timeout), call: healthy},
+		{Run: fmt.Sprintf("switch %s to %s (%s)", s.Name, placeholder, target), call: cutover, cutover: true},
+		{Run: fmt.Sprintf("docker stop/rm previous %s containers", s.Name), call: retire},
+	}
+}
+
+// liveContainer records which container serves a blue/green service
+type liveContainer struct {
+	Service    string    `json:"service"`
+	Container  string    `json:"container"`
+	Switch     string    `json:"switch"`
+	Listen     string    `json:"listen,omitempty"`
+	Port       int       `json:"port,omitempty"`
+	Network    string    `json:"network,omitempty"`
+	DockerHost string    `json:"docker_host"`
+	SwitchedAt time.Time `json:"switched_at"`
+}
+
+// resolve returns the ip:port the container takes traffic on
+func (l liveContainer) resolve(ctx context.Context) (string, error) {
+	c, err := dockerClientFor(l.DockerHost)
+	if err != nil {
+		return "", err
+	}
+	container, err := c.inspectContainer(ctx, l.Container)
+	if err != nil {
+		return "", err
+	}
+	ip := container.address(l.Network)
+	if ip == "" {
+		return "", fmt.Errorf("%s has no IP address", l.Container)
+	}
+	return net.JoinHostPort(ip, strconv.Itoa(l.Port)), nil
+}
+
+// trafficRouter runs the built-in proxies of blue/green services and keeps
+// track of their live containers
+type trafficRouter struct {
+	mu      sync.Mutex
+	store   *fileStore
+	proxies map[string]*tcpProxy // by listen address
+}
+
+var traffic *trafficRouter
+
+// newTrafficRouter restarts the proxies recorded in the store
+func newTrafficRouter(store *fileStore) *trafficRouter {
+	r := &trafficRouter{store: store, proxies: make(map[string]*tcpProxy)}
+	for _, service := range store.keys(blueGreenBucket) {
+		var rec liveContainer
+		if _, err := store.get(blueGreenBucket, service, &rec); err != nil {
+			log.Printf("Skipping blue/green state of %s: %v", service, err)
+			continue
+		}
+		if rec.Switch != switchProxy {
+			continue
+		}
+		if err := r.route(rec, ""); err != nil {
+			log.Printf("Cannot proxy %s to %s: %v", rec.Listen, rec.Container, err)
+			continue
+		}
+		log.Printf("Proxying %s to %s (%s)", rec.Listen, rec.Container, rec.Service)
+	}
+	return r
+}
+
+// live returns the recorded live container of a service
+func (r *trafficRouter) live(service string) (liveContainer, bool) {
+	var rec liveContainer
+	if r == nil {
+		return rec, false
+	}
+	ok, err := r.store.get(blueGreenBucket, service, &rec)
+	return rec, ok && err == nil
+}
+
+func (r *trafficRouter) record(rec liveContainer) error {
+	return r.store.put(blueGreenBucket, rec.Service, &rec)
+}
+
+// route points the proxy on rec.Listen at rec.Container (at addr, or looked
+// up on first use), starting the listener if needed. A listen address
+// belongs to one service.
+func (r *trafficRouter) route(rec liveContainer, addr string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p := r.proxies[rec.Listen]
+	if p == nil {
+		ln, err := net.Listen("tcp", rec.Listen)
+		if err != nil {
+			return err
+		}
+		p = &tcpProxy{ln: ln}
+		r.proxies[rec.Listen] = p
+		go p.serve()
+	} else if current := p.target(); current.Service != rec.Service {
+		return fmt.Errorf("%s is already the proxy of %s", rec.Listen, current.Service)
+	}
+	p.mu.Lock()
+	p.live, p.addr = rec, addr
+	p.mu.Unlock()
+	return nil
+}
+
+// tcpProxy forwards connections to the live container of a service.
+// Connections stay with the container they were opened to, so the previous
+// container finishes its in-flight requests before it is stopped.
+type tcpProxy struct {
+	ln   net.Listener
+	mu   sync.Mutex
+	live liveContainer
+	addr string // resolved address of live.Container, "" until known
+}
+
+func (p *tcpProxy) target() liveContainer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.live
+}
+
+func (p *tcpProxy) serve() {
+	for {
+		conn, err := p.ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("Proxy %s: %v", p.ln.Addr(), err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go p.forward(conn)
+	}
+}
+
+func (p *tcpProxy) forward(client net.Conn) {
+	defer client.Close()
+	upstream, err := p.dial()
+	if err != nil {
+		log.Printf("Proxy %s: %v", p.ln.Addr(), err)
+		return
+	}
+	defer upstream.Close()
+
+	done := make(chan struct{}, 2)
+	pipe := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		if tcp, ok := dst.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		}
+		done <- struct{}{}
+	}
+	go pipe(upstream, client)
+	go pipe(client, upstream)
+	<-done
+	<-done
+}
+
+// dial connects to the live container. Its address is looked up again when
+// it is not known yet or stopped working, e.g. after a restart gave the
+// container a new IP.
+func (p *tcpProxy) dial() (net.Conn, error) {
+	p.mu.Lock()
+	live, addr := p.live, p.addr
+	p.mu.Unlock()
+	if addr != "" {
+		if conn, err := net.DialTimeout("tcp", addr, 5*time.Second); err == nil {
+			return conn, nil
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	fresh, err := live.resolve(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	if p.live.Container == live.Container {
+		p.addr = fresh
+	}
+	p.mu.Unlock()
+	return net.DialTimeout("tcp", fresh, 5*time.Second)
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const usage = `Usage: webhook-deploy [command] [flags]
+
+Commands:
+  serve     start the webhook server (default)
+  validate  check the configuration without starting the server
+  plan      show what a webhook payload would deploy, without running it
+
+Run "webhook-deploy <command> -h" for the flags of a command.
+`
+
+// Discord webhook URLs look like https://discord.com/api/webhooks/<id>/<token>
+var discordWebhookPattern = regexp.MustCompile(`^/api/webhooks/[0-9]+/[A-Za-z0-9_-]+$`)
+
+func runValidate(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	configFile := fs.String("config", "", "pipeline file (default $CONFIG_FILE or deploy.yaml)")
+	strict := fs.Bool("strict", false, "treat warnings as errors")
+	fs.Parse(args)
+
+	cfg, err := loadCLIConfig(*configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR %v\n", err)
+		return 1
+	}
+
+	errorCount := 0
+	if err := cfg.validate(); err != nil {
+		for _, line := range strings.Split(err.Error(), "\n") {
+			fmt.Printf("ERROR %s\n", line)
+			errorCount++
+		}
+	}
+	warnings := auditConfig(cfg)
+	for _, w := range warnings {
+		fmt.Printf("WARN  %s\n", w)
+	}
+
+	source := cfg.File
+	if source == "" {
+		source = "environment variables"
+	}
+	fmt.Printf("%s: %d repositories, %d errors, %d warnings\n", source, len(cfg.Repos), errorCount, len(warnings))
+
+	if errorCount > 0 || (*strict && len(warnings) > 0) {
+		return 1
+	}
+	return 0
+}
+
+// auditConfig finds problems that do not stop the server from starting but
+// will most likely break a deployment: missing directories, a placeholder
+// secret, a notification URL that is not a Discord webhook.
+func auditConfig(cfg *Config) []string {
+	var warnings []string
+
+	if cfg.Secret == "your_secret_here" {
+		warnings = append(warnings, "server.secret: still set to the placeholder your_secret_here")
+	} else if len(cfg.Secret) < 16 {
+		warnings = append(warnings, fmt.Sprintf("server.secret: only %d characters, use at least 16", len(cfg.Secret)))
+	}
+
+	checkDiscord := func(where, raw string) {
+		if u, err := url.Parse(raw); err == nil && u.Scheme != "" {
+			host := strings.TrimPrefix(strings.TrimPrefix(strings.TrimPrefix(u.Hostname(), "ptb."), "canary."), "www.")
+			if (host != "discord.com" && host != "discordapp.com") || !discordWebhookPattern.MatchString(u.Path) {
+				warnings = append(warnings, fmt.Sprintf("%s: %s is not a Discord webhook URL", where, raw))
+			}
+		}
+	}
+	checkWorkDir := func(where, dir string) {
+		if dir == "" {
+			return
+		}
+		if info, err := os.Stat(dir); err != nil {
+			warnings = append(warnings, fmt.Sprintf("%s: work dir %s does not exist", where, dir))
+		} else if !info.IsDir() {
+			warnings = append(warnings, fmt.Sprintf("%s: work dir %s is not a directory", where, dir))
+		}
+	}
+
+	checkEnvironment := func(where string, env EnvironmentConfig) {
+		checkDiscord(where+".notify.discord_webhook", env.Notify.DiscordWebhook)
+		for _, name := range sortedKeys(env.Secrets) {
+			if env.Secrets[name] == "" {
+				warnings = append(warnings, fmt.Sprintf("%s.secrets.%s: empty (unset environment variable?)", where, name))
+			}
+		}
+	}
+
+	checkDiscord("server.discord_webhook", cfg.DiscordWebhook)
+	for _, name := range environmentNames(cfg.Environments) {
+		checkEnvironment("environments."+name, cfg.Environments[name])
+	}
+	checkDiscord("defaults.notify.discord_webhook", cfg.Defaults.Notify.DiscordWebhook)
+	checkWorkDir("defaults", cfg.Defaults.WorkDir)
+	for _, name := range cfg.repoNames() {
+		repo := cfg.Repos[name]
+		checkDiscord("repos."+name+".notify.discord_webhook", repo.Notify.DiscordWebhook)
+		checkWorkDir("repos."+name, repo.WorkDir)
+		for _, env := range environmentNames(repo.Environments) {
+			checkEnvironment("repos."+name+".environments."+env, repo.Environments[env])
+		}
+		if len(repo.Steps) == 0 && len(cfg.Defaults.Steps) == 0 && repo.ProjectType == "" {
+			warnings = append(warnings, fmt.Sprintf("repos.%s: no steps or project_type, commands will be auto-detected", name))
+		}
+	}
+
+	// Repositories still configured the old way
+	for _, kv := range os.Environ() {
+		key, value, _ := strings.Cut(kv, "=")
+		if key == "WORK_DIR" || strings.HasPrefix(key, "WORK_DIR_") {
+			checkWorkDir(key, strings.TrimSpace(value))
+		}
+	}
+
+	return warnings
+}
+
+func runPlan(args []string) int {
+	fs := flag.NewFlagSet("plan", flag.ExitOnError)
+	configFile := fs.String("config", "", "pipeline file (default $CONFIG_FILE or deploy.yaml)")
+	payloadFile := fs.String("payload", "", "JSON webhook payload to plan (- for stdin)")
+	eventType := fs.String("event", "", "value of the X-GitHub-Event header")
+	var headers headerList
+	fs.Var(&headers, "header", "request header as 'Name: value', repeatable")
+	fs.Parse(args)
+
+	if *payloadFile == "" {
+		fmt.Fprintln(os.Stderr, "plan: --payload is required")
+		fs.Usage()
+		return 2
+	}
+
+	cfg, err := loadCLIConfig(*configFile)
+	if err == nil {
+		err = cfg.validate()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading configuration: %v\n", err)
+		return 1
+	}
+
+	var body []byte
+	if *payloadFile == "-" {
+		body, err = io.ReadAll(os.Stdin)
+	} else {
+		body, err = os.ReadFile(*payloadFile)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading payload: %v\n", err)
+		return 1
+	}
+
+	// The provider is picked by the headers, as the server does; signatures
+	// are not checked
+	r := &http.Request{Header: http.Header{}}
+	if *eventType != "" {
+		r.Header.Set("X-GitHub-Event", *eventType)
+	}
+	for _, header := range headers {
+		name, value, _ := strings.Cut(header, ":")
+		r.Header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	source := findProvider(r, body)
+	event, err := source.parse(r, body)
+	if err == nil {
+		err = routeImage(cfg, &event)
+		routeRef(cfg, &event)
+	}
+	var reply replyEvent
+	var ignore ignoreEvent
+	if errors.As(err, &reply) {
+		answer, _ := json.MarshalIndent(reply.reply(cfg), "", "  ")
+		fmt.Printf("Payload type:      %s (answered without deploying)\n%s\n", reply, answer)
+		return 0
+	} else if errors.As(err, &ignore) {
+		fmt.Printf("Payload type:      unknown (the webhook would be ignored: %s)\n", ignore)
+		return 0
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid payload: %v\n", err)
+		return 1
+	}
+	payload := event.Payload
+	fmt.Printf("Provider:          %s\n", event.Provider)
+	fmt.Printf("Payload type:      %s\n", event.Type)
+	fmt.Printf("Repository:        %s\n", event.Repository)
+
+	repoConfig, _ := cfg.repo(event.Repository)
+	if reason := repoConfig.skipReason(event); reason != "" {
+		fmt.Printf("Ignored:           %s (the webhook would be ignored)\n", reason)
+		return 0
+	}
+	if tag := event.tag(); tag != "" {
+		fmt.Printf("Tag:               %s\n", tag)
+	} else if branch := event.branch(); branch != "" {
+		fmt.Printf("Branch:            %s\n", branch)
+	}
+	if event.Workflow != "" {
+		fmt.Printf("Workflow:          %s\n", event.Workflow)
+	}
+
+	if event.Image != "" {
+		if _, err := workflowImage(cfg, payload); err != nil {
+			fmt.Printf("Rejected:          %v (the webhook would be answered with 400)\n", err)
+			return 0
+		}
+	}
+	if event.Environment != "" {
+		if err := cfg.checkEnvironment(event.Environment); err != nil {
+			fmt.Printf("Rejected:          %v (the webhook would be answered with 400)\n", err)
+			return 0
+		}
+		fmt.Printf("Environment:       %s\n", event.Environment)
+	}
+
+	plan := planDeployment(cfg, payload)
+	if plan.Image != "" {
+		fmt.Printf("Image:             %s\n", plan.Image)
+	}
+	workDir := plan.WorkDir
+	switch {
+	case plan.Docker:
+		workDir = "(none, Docker workflow)"
+	case workDir == "":
+		workDir = "(current directory)"
+	}
+	fmt.Printf("Working directory: %s\n", workDir)
+	for _, note := range plan.Notes {
+		fmt.Printf("Warning:           %s\n", note)
+	}
+
+	if len(plan.Steps) == 0 {
+		fmt.Println("Commands:          none, the deployment would fail")
+		return 0
+	}
+	if plan.Timeout > 0 {
+		fmt.Printf("Pipeline timeout:  %v\n", plan.Timeout)
+	}
+	fmt.Println("Commands:")
+	for i, step := range plan.Steps {
+		timeout := "no timeout"
+		if step.Timeout > 0 {
+			timeout = "timeout " + step.Timeout.String()
+		}
+		fmt.Printf("  %d. %s  (%s, %s)\n", i+1, step.Run, step.mode(), timeout)
+	}
+	return 0
+}
+
+// headerList collects the values of a repeatable flag
+type headerList []string
+
+func (h *headerList) String() string { return strings.Join(*h, ", ") }
+
+func (h *headerList) Set(value string) error {
+	if !strings.Contains(value, ":") {
+		return fmt.Errorf("%q is not a 'Name: value' header", value)
+	}
+	*h = append(*h, value)
+	return nil
+}
+
+// loadCLIConfig loads the config from --config, falling back to the same
+// lookup the server uses.
+func loadCLIConfig(file string) (*Config, error) {
+	if file != "" {
+		return loadConfigFile(file, true)
+	}
+	return loadConfig()
+}
@@ -0,0 +1,778 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Default location of the pipeline file, overridable with CONFIG_FILE
+const defaultConfigFile = "deploy.yaml"
+
+// Project types autoDetectDeployCommands knows how to build
+var knownProjectTypes = []string{"go", "nodejs", "python", "php", "java", "dotnet", "docker"}
+
+type Config struct {
+	Port           string
+	Secret         string
+	DiscordWebhook string
+
+	// Secret token of GitLab webhooks, compared with X-Gitlab-Token
+	GitLabToken string
+	// HMAC secret of Gitea/Forgejo webhooks
+	GiteaSecret string
+	// HMAC secret of Bitbucket webhooks
+	BitbucketSecret string
+	// Token in the URL of Docker Hub webhooks ("" rejects them)
+	DockerHubToken string
+	// Authorization header of Harbor webhooks ("" rejects them)
+	HarborAuth string
+
+	// How long shutdown waits for running deployments and notifications
+	ShutdownGracePeriod time.Duration
+
+	// Bearer token for the deployment API ("" disables the API)
+	APIToken string
+
+	// Where the job queue and other state is persisted
+	DataDir string
+	Queue   QueueConfig
+
+	// How Docker workflows talk to the Docker daemon
+	Docker DockerConfig
+
+	// File is the pipeline file the config was loaded from ("" when only env vars are used)
+	File     string
+	Defaults RepoConfig
+	Repos    map[string]RepoConfig // keyed by lower-case full name, e.g. "owner/repo"
+
+	// Environments is the registry of deployment environments; workflow
+	// payloads naming any other environment are rejected
+	Environments map[string]EnvironmentConfig
+}
+
+// QueueConfig limits the deployment job queue
+type QueueConfig struct {
+	MaxWorkers int           `yaml:"max_workers"`  // deployments running at the same time
+	MaxQueued  int           `yaml:"max_queued"`   // jobs waiting across all repositories
+	MaxPerRepo int           `yaml:"max_per_repo"` // jobs waiting per repository/environment
+	RetryAfter time.Duration `yaml:"retry_after"`  // suggested back-off when the queue is full
+	Debounce   time.Duration `yaml:"debounce"`     // wait for newer pushes and deploy only the latest
+}
+
+// DockerConfig selects the executor of Docker workflows
+type DockerConfig struct {
+	Executor string `yaml:"executor"` // "api" (Engine API) or "cli" (docker commands)
+	Host     string `yaml:"host"`     // daemon address of the api executor
+}
+
+// RepoConfig describes the deployment pipeline of one repository
+type RepoConfig struct {
+	WorkDir     string            `yaml:"work_dir"`
+	ProjectType string            `yaml:"project_type"`
+	Branches    []string          `yaml:"branches"`
+	Tags        []string          `yaml:"tags"`      // tags that deploy, default matched against branches
+	Workflows   []string          `yaml:"workflows"` // GitHub Actions workflows whose successful runs deploy
+	Env         map[string]string `yaml:"env"`
+	Steps       []Step            `yaml:"steps"`
+	StepTimeout time.Duration     `yaml:"step_timeout"` // default for steps without their own timeout
+	Timeout     time.Duration     `yaml:"timeout"`      // deadline of the whole pipeline
+	Shell       *bool             `yaml:"shell"`        // default execution mode of the steps
+	Images      ImagePolicy       `yaml:"images"`       // images workflow payloads may deploy
+	Container   ContainerSpec     `yaml:"container"`    // how Docker workflows run the image
+	Readiness   ReadinessCheck    `yaml:"readiness"`    // probed after the steps
+	Watch       CrashWatch        `yaml:"watch"`        // of the container a Docker workflow started
+	Notify      NotifyConfig      `yaml:"notify"`
+
+	// Registry pushes that deploy the repository, never taken from the defaults
+	ImageTriggers []ImageTrigger `yaml:"image_triggers"`
+
+	// Per-environment settings, keyed by the workflow payload's environment
+	Environments map[string]EnvironmentConfig `yaml:"environments"`
+}
+
+// Step is a single command of a pipeline. In YAML it can be written either
+// as a plain string or as a mapping with a name.
+//
+// By default a command is split into arguments with POSIX quoting rules and
+// run directly. With shell: true it is handed to /bin/sh -c instead, which
+// is needed for pipes, &&, || true, redirects and variable expansion.
+type Step struct {
+	Name    string        `yaml:"name"`
+	Run     string        `yaml:"run"`
+	Timeout time.Duration `yaml:"timeout"`
+	Shell   *bool         `yaml:"shell"`
+
+	// Extra environment of the command, set by generated steps only
+	Env map[string]string `yaml:"-"`
+	// call replaces the command for steps that run in-process
+	call stepFunc
+	// cutover marks the step where the previous version stops serving
+	cutover bool
+}
+
+// useShell reports whether the step runs through /bin/sh, falling back to
+// the repository default when the step does not say
+func (s Step) useShell(repoDefault *bool) bool {
+	if s.Shell != nil {
+		return *s.Shell
+	}
+	return repoDefault != nil && *repoDefault
+}
+
+// mode names the execution mode for logs and plan output
+func (s Step) mode() string {
+	if s.call != nil {
+		return "api"
+	}
+	if s.useShell(nil) {
+		return "shell"
+	}
+	return "argv"
+}
+
+type NotifyConfig struct {
+	DiscordWebhook string `yaml:"discord_webhook"`
+	Enabled        *bool  `yaml:"enabled"`
+}
+
+// fileConfig is the on-disk layout of deploy.yaml
+type fileConfig struct {
+	Server struct {
+		Port            string `yaml:"port"`
+		Secret          string `yaml:"secret"`
+		DiscordWebhook  string `yaml:"discord_webhook"`
+		GitLabToken     string `yaml:"gitlab_token"`
+		GiteaSecret     string `yaml:"gitea_secret"`
+		BitbucketSecret string `yaml:"bitbucket_secret"`
+		DockerHubToken  string `yaml:"dockerhub_token"`
+		HarborAuth      string `yaml:"harbor_auth"`
+
+		ShutdownGracePeriod time.Duration `yaml:"shutdown_grace_period"`
+		APIToken            string        `yaml:"api_token"`
+		DataDir             string        `yaml:"data_dir"`
+		Queue               QueueConfig   `yaml:"queue"`
+		Docker              DockerConfig  `yaml:"docker"`
+	} `yaml:"server"`
+	Environments map[string]EnvironmentConfig `yaml:"environments"`
+	Defaults     RepoConfig                   `yaml:"defaults"`
+	Repos        map[string]RepoConfig        `yaml:"repos"`
+}
+
+func (s *Step) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		s.Run = value.Value
+		return nil
+	}
+
+	type rawStep Step
+	var raw rawStep
+	if err := value.Decode(&raw); err != nil {
+		return err
+	}
+	*s = Step(raw)
+	return nil
+}
+
+// loadConfig builds the configuration from the pipeline file (if any) with
+// environment variables as a fallback.
+func loadConfig() (*Config, error) {
+	return loadConfigFile(configPath())
+}
+
+// loadConfigFile is loadConfig for a given file. An explicitly configured
+// file that does not exist is an error; the default deploy.yaml is optional.
+func loadConfigFile(file string, explicit bool) (*Config, error) {
+	var fc fileConfig
+	data, err := os.ReadFile(file)
+	switch {
+	case err == nil:
+		fc, err = parseConfigFile(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+	case errors.Is(err, os.ErrNotExist) && !explicit:
+		file = ""
+	default:
+		return nil, err
+	}
+
+	cfg := &Config{
+		Port:            firstNonEmpty(fc.Server.Port, getEnv("PORT", "8300")),
+		Secret:          firstNonEmpty(os.ExpandEnv(fc.Server.Secret), getEnv("WEBHOOK_SECRET", "your_secret_here")),
+		DiscordWebhook:  firstNonEmpty(os.ExpandEnv(fc.Server.DiscordWebhook), getEnv("DISCORD_WEBHOOK", "https://discord.com/api/webhooks/1393287834173050990/9Mb6VxMhpB_UOqf9HEXkbV85N0sLRIpeGDZqFHuQGiZwjzx_FQzt_Xh-Vg6ozo0PJcCa")),
+		APIToken:        firstNonEmpty(os.ExpandEnv(fc.Server.APIToken), getEnv("API_TOKEN", "")),
+		GitLabToken:     firstNonEmpty(os.ExpandEnv(fc.Server.GitLabToken), getEnv("GITLAB_TOKEN", "")),
+		GiteaSecret:     firstNonEmpty(os.ExpandEnv(fc.Server.GiteaSecret), getEnv("GITEA_SECRET", "")),
+		BitbucketSecret: firstNonEmpty(os.ExpandEnv(fc.Server.BitbucketSecret), getEnv("BITBUCKET_SECRET", "")),
+		DockerHubToken:  firstNonEmpty(os.ExpandEnv(fc.Server.DockerHubToken), getEnv("DOCKERHUB_TOKEN", "")),
+		HarborAuth:      firstNonEmpty(os.ExpandEnv(fc.Server.HarborAuth), getEnv("HARBOR_AUTH", "")),
+		DataDir:         firstNonEmpty(fc.Server.DataDir, getEnv("DATA_DIR", "data")),
+		File:            file,
+		Defaults:        fc.Defaults,
+		Repos:           make(map[string]RepoConfig, len(fc.Repos)),
+	}
+	cfg.GiteaSecret = firstNonEmpty(cfg.GiteaSecret, cfg.Secret)
+	cfg.BitbucketSecret = firstNonEmpty(cfg.BitbucketSecret, cfg.Secret)
+	cfg.Defaults.Notify.DiscordWebhook = os.ExpandEnv(cfg.Defaults.Notify.DiscordWebhook)
+	cfg.Defaults.Environments = expandEnvironments(fc.Defaults.Environments)
+	cfg.Environments = expandEnvironments(fc.Environments)
+	if len(cfg.Environments) == 0 {
+		cfg.Environments = defaultEnvironments()
+	}
+
+	if cfg.ShutdownGracePeriod, err = durationSetting(fc.Server.ShutdownGracePeriod, "SHUTDOWN_GRACE_PERIOD", 2*time.Minute); err != nil {
+		return nil, err
+	}
+	if cfg.Defaults.StepTimeout, err = durationSetting(fc.Defaults.StepTimeout, "DEPLOY_STEP_TIMEOUT", 10*time.Minute); err != nil {
+		return nil, err
+	}
+	if cfg.Defaults.Timeout, err = durationSetting(fc.Defaults.Timeout, "DEPLOY_TIMEOUT", 30*time.Minute); err != nil {
+		return nil, err
+	}
+	if cfg.Queue.RetryAfter, err = durationSetting(fc.Server.Queue.RetryAfter, "QUEUE_RETRY_AFTER", 30*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.Queue.Debounce, err = durationSetting(fc.Server.Queue.Debounce, "QUEUE_DEBOUNCE", 0); err != nil {
+		return nil, err
+	}
+	if cfg.Queue.MaxWorkers, err = intSetting(fc.Server.Queue.MaxWorkers, "QUEUE_MAX_WORKERS", 2); err != nil {
+		return nil, err
+	}
+	if cfg.Queue.MaxQueued, err = intSetting(fc.Server.Queue.MaxQueued, "QUEUE_MAX_QUEUED", 100); err != nil {
+		return nil, err
+	}
+	if cfg.Queue.MaxPerRepo, err = intSetting(fc.Server.Queue.MaxPerRepo, "QUEUE_MAX_PER_REPO", 10); err != nil {
+		return nil, err
+	}
+	cfg.Docker.Executor = firstNonEmpty(fc.Server.Docker.Executor, getEnv("DOCKER_EXECUTOR", "api"))
+	cfg.Docker.Host = firstNonEmpty(fc.Server.Docker.Host, getEnv("DOCKER_HOST", defaultDockerHost))
+	if cfg.Defaults.Shell == nil {
+		if raw := os.Getenv("DEPLOY_SHELL"); raw != "" {
+			shell, err := strconv.ParseBool(strings.TrimSpace(raw))
+			if err != nil {
+				return nil, fmt.Errorf("DEPLOY_SHELL: %w", err)
+			}
+			cfg.Defaults.Shell = &shell
+		}
+	}
+	cfg.Defaults.Images.Registries = listSetting(fc.Defaults.Images.Registries, "DOCKER_ALLOWED_REGISTRIES")
+	cfg.Defaults.Images.Namespaces = listSetting(fc.Defaults.Images.Namespaces, "DOCKER_ALLOWED_NAMESPACES")
+
+	for name, repo := range fc.Repos {
+		key := strings.ToLower(strings.TrimSpace(name))
+		if _, dup := cfg.Repos[key]; dup {
+			return nil, fmt.Errorf("%s: repository %q is defined more than once", file, name)
+		}
+		repo.Notify.DiscordWebhook = os.ExpandEnv(repo.Notify.DiscordWebhook)
+		repo.Environments = expandEnvironments(repo.Environments)
+		cfg.Repos[key] = repo
+	}
+
+	return cfg, nil
+}
+
+// durationSetting resolves a duration from the file, then the env var, then the default
+func durationSetting(fromFile time.Duration, envKey string, defaultValue time.Duration) (time.Duration, error) {
+	if fromFile != 0 {
+		return fromFile, nil
+	}
+	raw := os.Getenv(envKey)
+	if raw == "" {
+		return defaultValue, nil
+	}
+	d, err := time.ParseDuration(strings.TrimSpace(raw))
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", envKey, err)
+	}
+	return d, nil
+}
+
+// intSetting is durationSetting for integers
+func intSetting(fromFile int, envKey string, defaultValue int) (int, error) {
+	if fromFile != 0 {
+		return fromFile, nil
+	}
+	raw := os.Getenv(envKey)
+	if raw == "" {
+		return defaultValue, nil
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(raw))
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", envKey, err)
+	}
+	return n, nil
+}
+
+// listSetting reads a comma-separated list from the environment unless the
+// file sets one
+func listSetting(fromFile []string, envKey string) []string {
+	if len(fromFile) > 0 {
+		return fromFile
+	}
+	var values []string
+	for _, v := range strings.Split(os.Getenv(envKey), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// configPath returns the pipeline file location and whether it was set explicitly
+func configPath() (string, bool) {
+	if file := os.Getenv("CONFIG_FILE"); file != "" {
+		return file, true
+	}
+	return defaultConfigFile, false
+}
+
+// validate checks the config for mistakes that would only show up once a
+// webhook arrives. All problems are reported at once.
+func (c *Config) validate() error {
+	var errs []error
+	watched := false // a crash-loop watch talks to docker.host whatever the executor
+	images := false  // workflow or registry payloads can deploy an image
+	checkArgs := func(where string, spec ContainerSpec) {
+		if len(spec.Args) > 0 && c.Docker.Executor == "api" {
+			errs = append(errs, fmt.Errorf("%s.args: docker CLI flags need server.docker.executor: cli", where))
+		}
+	}
+	check := func(where string, rc RepoConfig) {
+		shell := rc.Shell
+		if shell == nil {
+			shell = c.Defaults.Shell
+		}
+		for i, step := range rc.Steps {
+			if strings.TrimSpace(step.Run) == "" {
+				errs = append(errs, fmt.Errorf("%s: step %d has no command", where, i+1))
+			} else if !step.useShell(shell) {
+				if _, _, err := splitCommandLine(step.Run); err != nil {
+					errs = append(errs, fmt.Errorf("%s: step %d: %w", where, i+1, err))
+				}
+			}
+			if step.Timeout < 0 {
+				errs = append(errs, fmt.Errorf("%s: step %d has a negative timeout", where, i+1))
+			}
+		}
+		if rc.StepTimeout < 0 || rc.Timeout < 0 {
+			errs = append(errs, fmt.Errorf("%s: step_timeout and timeout must not be negative", where))
+		}
+		for _, pattern := range rc.Branches {
+			if _, err := path.Match(pattern, ""); err != nil {
+				errs = append(errs, fmt.Errorf("%s: invalid branch pattern %q", where, pattern))
+			}
+		}
+		for _, pattern := range rc.Tags {
+			if _, err := path.Match(pattern, ""); err != nil {
+				errs = append(errs, fmt.Errorf("%s: invalid tag pattern %q", where, pattern))
+			}
+		}
+		for _, pattern := range rc.Workflows {
+			if _, err := path.Match(pattern, ""); err != nil {
+				errs = append(errs, fmt.Errorf("%s: invalid workflow pattern %q", where, pattern))
+			}
+		}
+		for _, pattern := range append(rc.Images.Registries, rc.Images.Namespaces...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				errs = append(errs, fmt.Errorf("%s: invalid image pattern %q", where, pattern))
+			}
+		}
+		if rc.ProjectType != "" && !containsString(knownProjectTypes, rc.ProjectType) {
+			errs = append(errs, fmt.Errorf("%s: unknown project type %q (expected one of %s)",
+				where, rc.ProjectType, strings.Join(knownProjectTypes, ", ")))
+		}
+		errs = append(errs, rc.Container.validate(where+".container")...)
+		errs = append(errs, rc.Readiness.validate(where+".readiness")...)
+		errs = append(errs, rc.Watch.validate(where+".watch")...)
+		watched = watched || rc.Watch.Window > 0
+		images = images || len(rc.Images.Registries) > 0 || len(rc.ImageTriggers) > 0
+		checkArgs(where+".container", rc.Container)
+		for _, name := range environmentNames(rc.Environments) {
+			watched = watched || rc.Environments[name].Watch.Window > 0
+			checkArgs(where+".environments."+name+".container", rc.Environments[name].Container)
+			if _, ok := c.Environments[name]; !ok {
+				errs = append(errs, fmt.Errorf("%s.environments: %q is not in the environments registry", where, name))
+			}
+			errs = append(errs, rc.Environments[name].validate(where+".environments."+name)...)
+		}
+		if rc.Notify.DiscordWebhook != "" {
+			if err := checkWebhookURL(rc.Notify.DiscordWebhook); err != nil {
+				errs = append(errs, fmt.Errorf("%s: notify.discord_webhook: %w", where, err))
+			}
+		}
+		for i, trigger := range rc.ImageTriggers {
+			errs = append(errs, trigger.validate(fmt.Sprintf("%s.image_triggers[%d]", where, i), c.Environments)...)
+		}
+	}
+
+	if err := checkWebhookURL(c.DiscordWebhook); err != nil {
+		errs = append(errs, fmt.Errorf("server.discord_webhook: %w", err))
+	}
+	if c.ShutdownGracePeriod < 0 {
+		errs = append(errs, fmt.Errorf("server.shutdown_grace_period: must not be negative"))
+	}
+	if c.Queue.MaxWorkers < 1 || c.Queue.MaxQueued < 1 || c.Queue.MaxPerRepo < 1 {
+		errs = append(errs, fmt.Errorf("server.queue: max_workers, max_queued and max_per_repo must be at least 1"))
+	}
+	if c.Queue.Debounce < 0 {
+		errs = append(errs, fmt.Errorf("server.queue.debounce: must not be negative"))
+	}
+	if c.Docker.Executor != "api" && c.Docker.Executor != "cli" {
+		errs = append(errs, fmt.Errorf("server.docker.executor: %q is not api or cli", c.Docker.Executor))
+	}
+	for _, name := range environmentNames(c.Environments) {
+		if !containerNamePattern.MatchString(name) {
+			errs = append(errs, fmt.Errorf("environments: %q is not a valid environment name", name))
+		}
+		errs = append(errs, c.Environments[name].validate("environments."+name)...)
+		checkArgs("environments."+name+".container", c.Environments[name].Container)
+		watched = watched || c.Environments[name].Watch.Window > 0
+	}
+	check("defaults", c.Defaults)
+	if len(c.Defaults.ImageTriggers) > 0 {
+		errs = append(errs, fmt.Errorf("defaults.image_triggers: triggers name one repository, set them under repos"))
+	}
+	for _, name := range c.repoNames() {
+		if !strings.Contains(name, "/") || strings.Contains(name, "//") || strings.HasPrefix(name, "/") || strings.HasSuffix(name, "/") {
+			errs = append(errs, fmt.Errorf("repos.%s: expected an owner/name (or GitLab group/subgroup/name) key", name))
+		}
+		check("repos."+name, c.Repos[name])
+	}
+	errs = append(errs, c.validateEnvCommands()...)
+	// Without Docker deployments the executor never runs, so a DOCKER_HOST
+	// meant for other tools (e.g. ssh://) does not matter
+	if (c.Docker.Executor == "api" && images) || watched {
+		if _, err := newDockerClient(c.Docker.Host); err != nil {
+			errs = append(errs, fmt.Errorf("server.docker.host: %w", err))
+		}
+	}
+	errs = append(errs, c.validateBlueGreen()...)
+
+	return errors.Join(errs...)
+}
+
+// validateEnvCommands checks the DEPLOY_COMMANDS and DEPLOY_COMMANDS_*
+// variables of repositories still configured the old way. Like steps, their
+// commands run without a shell unless DEPLOY_SHELL or defaults.shell is set.
+func (c *Config) validateEnvCommands() []error {
+	if c.Defaults.Shell != nil && *c.Defaults.Shell {
+		return nil
+	}
+	var errs []error
+	for _, key := range envCommandVars() {
+		for i, command := range strings.Split(os.Getenv(key), ";") {
+			if strings.TrimSpace(command) == "" {
+				continue
+			}
+			if _, _, err := splitCommandLine(command); err != nil {
+				errs = append(errs, fmt.Errorf("%s: command %d: %w, or set DEPLOY_SHELL=true to run these commands through /bin/sh", key, i+1, err))
+			}
+		}
+	}
+	return errs
+}
+
+// envCommandVars returns the names of the DEPLOY_COMMANDS variables that are
+// set, in sorted order
+func envCommandVars() []string {
+	var keys []string
+	for _, kv := range os.Environ() {
+		key, value, _ := strings.Cut(kv, "=")
+		if (key == "DEPLOY_COMMANDS" || strings.HasPrefix(key, "DEPLOY_COMMANDS_")) && value != "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// validateBlueGreen checks every blue_green environment as it resolves for
+// each repository. Unlisted repositories get the defaults, checked under the
+// registry entry's name.
+func (c *Config) validateBlueGreen() []error {
+	var errs []error
+	reported := make(map[string]bool)
+	proxies := make(map[string]string) // listen address -> where
+	check := func(where, repoName string, rc RepoConfig, listed bool) {
+		for _, envName := range environmentNames(c.Environments) {
+			env, _ := c.environment(rc, envName)
+			if env.Strategy != strategyBlueGreen {
+				continue
+			}
+			var err error
+			if c.Docker.Executor != "api" {
+				err = fmt.Errorf("strategy blue_green needs server.docker.executor: api")
+			}
+			service, serviceErr := newBlueGreenService(rc.containerSpec(repoName, envName, env), env.BlueGreen)
+			if err == nil {
+				err = serviceErr
+			}
+			if err != nil {
+				// Report a mistake inherited from the registry only once
+				if !reported[envName+err.Error()] {
+					reported[envName+err.Error()] = true
+					errs = append(errs, fmt.Errorf("%s: %w", where+envName, err))
+				}
+				continue
+			}
+			if !listed || service.Switch != switchProxy {
+				continue
+			}
+			if other, ok := proxies[service.Listen]; ok {
+				errs = append(errs, fmt.Errorf("%s: proxy address %s is already used by %s", where+envName, service.Listen, other))
+			} else if _, port, _ := net.SplitHostPort(service.Listen); port == c.Port {
+				errs = append(errs, fmt.Errorf("%s: proxy address %s is the webhook server's port", where+envName, service.Listen))
+			}
+			proxies[service.Listen] = where + envName
+		}
+	}
+
+	defaults, _ := c.repo("")
+	check("environments.", "<repository>", defaults, false)
+	for _, name := range c.repoNames() {
+		rc, _ := c.repo(name)
+		_, repoName, _ := strings.Cut(name, "/")
+		check("repos."+name+".environments.", repoName, rc, true)
+	}
+	return errs
+}
+
+// environment resolves a deployment environment for a repository: the
+// registry entry with the repository's section for it (merged over the
+// defaults' by repo) applied on top. It reports false for unknown names.
+func (c *Config) environment(rc RepoConfig, name string) (EnvironmentConfig, bool) {
+	env, ok := c.Environments[name]
+	if !ok {
+		return env, false
+	}
+	return env.merge(rc.Environments[name]), true
+}
+
+// checkEnvironment rejects environment names missing from the registry
+func (c *Config) checkEnvironment(name string) error {
+	if _, ok := c.Environments[name]; ok {
+		return nil
+	}
+	return fmt.Errorf("unknown environment %q (configured: %s)", name, strings.Join(environmentNames(c.Environments), ", "))
+}
+
+// repoNames returns the configured repositories in a stable order
+func (c *Config) repoNames() []string {
+	names := make([]string, 0, len(c.Repos))
+	for name := range c.Repos {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func checkWebhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%q is not an http(s) URL", raw)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("%q has no host", raw)
+	}
+	return nil
+}
+
+func parseConfigFile(data []byte) (fileConfig, error) {
+	var fc fileConfig
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true) // typos in keys should fail loudly instead of being ignored
+	if err := dec.Decode(&fc); err != nil && !errors.Is(err, io.EOF) {
+		return fc, err
+	}
+	return fc, nil
+}
+
+// repo returns the pipeline of a repository merged over the defaults. The
+// second result reports whether the repository is listed in the file.
+func (c *Config) repo(fullName string) (RepoConfig, bool) {
+	rc, ok := c.Repos[strings.ToLower(fullName)]
+	d := c.Defaults
+
+	merged := RepoConfig{
+		WorkDir:     firstNonEmpty(rc.WorkDir, d.WorkDir),
+		ProjectType: firstNonEmpty(rc.ProjectType, d.ProjectType),
+		Branches:    rc.Branches,
+		Tags:        rc.Tags,
+		Workflows:   rc.Workflows,
+		Steps:       rc.Steps,
+		StepTimeout: rc.StepTimeout,
+		Timeout:     rc.Timeout,
+		Shell:       rc.Shell,
+		Images:      rc.Images,
+		Container:   d.Container.merge(rc.Container),
+		Readiness:   d.Readiness.merge(rc.Readiness),
+		Watch:       d.Watch.merge(rc.Watch),
+		Notify:      rc.Notify,
+
+		ImageTriggers: rc.ImageTriggers,
+		Environments:  mergeEnvironments(d.Environments, rc.Environments),
+	}
+	if merged.Branches == nil {
+		merged.Branches = d.Branches
+	}
+	if merged.Tags == nil {
+		merged.Tags = d.Tags
+	}
+	if merged.Workflows == nil {
+		merged.Workflows = d.Workflows
+	}
+	if merged.Steps == nil {
+		merged.Steps = d.Steps
+	}
+	if merged.StepTimeout == 0 {
+		merged.StepTimeout = d.StepTimeout
+	}
+	if merged.Timeout == 0 {
+		merged.Timeout = d.Timeout
+	}
+	if merged.Shell == nil {
+		merged.Shell = d.Shell
+	}
+	if merged.Images.Registries == nil {
+		merged.Images.Registries = d.Images.Registries
+	}
+	if merged.Images.Namespaces == nil {
+		merged.Images.Namespaces = d.Images.Namespaces
+	}
+	if merged.Notify.DiscordWebhook == "" {
+		merged.Notify.DiscordWebhook = d.Notify.DiscordWebhook
+	}
+	if merged.Notify.Enabled == nil {
+		merged.Notify.Enabled = d.Notify.Enabled
+	}
+
+	// Repository env extends the defaults instead of replacing them
+	if len(d.Env) > 0 || len(rc.Env) > 0 {
+		merged.Env = make(map[string]string, len(d.Env)+len(rc.Env))
+		for k, v := range d.Env {
+			merged.Env[k] = v
+		}
+		for k, v := range rc.Env {
+			merged.Env[k] = v
+		}
+	}
+
+	return merged, ok
+}
+
+// allowsBranch reports whether a push to branch should trigger a deployment.
+// An empty filter allows everything; entries may use path.Match globs.
+func (rc RepoConfig) allowsBranch(branch string) bool {
+	if len(rc.Branches) == 0 || branch == "" {
+		return true
+	}
+	for _, pattern := range rc.Branches {
+		if ok, _ := path.Match(pattern, branch); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsTag reports whether pushing or releasing tag should trigger a
+// deployment. Without a tags filter the full ref is matched against the
+// branches, e.g. "refs/tags/v*".
+func (rc RepoConfig) allowsTag(tag string) bool {
+	if rc.Tags == nil {
+		return rc.allowsBranch("refs/tags/" + tag)
+	}
+	for _, pattern := range rc.Tags {
+		if ok, _ := path.Match(pattern, tag); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsWorkflow reports whether a successful run of the named GitHub
+// Actions workflow should trigger a deployment. Nothing is allowed until
+// workflows are configured.
+func (rc RepoConfig) allowsWorkflow(name string) bool {
+	for _, pattern := range rc.Workflows {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// skipReason explains why the filters of the repository do not deploy
+// event, "" when they do
+func (rc RepoConfig) skipReason(event deployEvent) string {
+	switch tag := event.tag(); {
+	case event.Workflow != "" && !rc.allowsWorkflow(event.Workflow):
+		return fmt.Sprintf("Workflow %s is not configured for deployment", event.Workflow)
+	case tag != "" && !rc.allowsTag(tag):
+		return fmt.Sprintf("Tag %s is not configured for deployment", tag)
+	case tag == "" && !rc.allowsBranch(event.branch()):
+		return fmt.Sprintf("Branch %s is not configured for deployment", event.branch())
+	}
+	return ""
+}
+
+// environ returns the process environment extended with the repository env
+func (rc RepoConfig) environ() []string {
+	return append(os.Environ(), envList(rc.Env)...)
+}
+
+// envList turns a map into NAME=value pairs in a stable order
+func envList(m map[string]string) []string {
+	env := make([]string, 0, len(m))
+	for _, k := range sortedKeys(m) {
+		env = append(env, k+"="+m[k])
+	}
+	return env
+}
+
+// discordWebhook returns the Discord URL notifications for this repository
+// go to, or "" if notifications are disabled.
+func (rc RepoConfig) discordWebhook(fallback string) string {
+	if rc.Notify.Enabled != nil && !*rc.Notify.Enabled {
+		return ""
+	}
+	return firstNonEmpty(rc.Notify.DiscordWebhook, fallback)
+}
+
+// repoEnvKey turns "owner/my-repo" into "OWNER_MY_REPO" for env var lookups
+func repoEnvKey(repoName string) string {
+	repoKey := strings.ReplaceAll(strings.ToUpper(repoName), "/", "_")
+	return strings.ReplaceAll(repoKey, "-", "_")
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
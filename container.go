@@ -0,0 +1,318 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	portPattern    = regexp.MustCompile(`^((\[[0-9a-fA-F:]+\]|[0-9.]+):)?([0-9]+(-[0-9]+)?:)?[0-9]+(-[0-9]+)?(/(tcp|udp|sctp))?$`)
+	memoryPattern  = regexp.MustCompile(`^[0-9]+[bkmgBKMG]?$`)
+	restartPattern = regexp.MustCompile(`^(no|always|unless-stopped|on-failure(:[0-9]+)?)$`)
+	envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	suffixPattern  = regexp.MustCompile(`^[a-zA-Z0-9_.-]*$`)
+)
+
+// ContainerSpec describes how the container of a Docker workflow is run.
+// Every field is optional; see containerSpec for how specs are layered.
+type ContainerSpec struct {
+	Name    string            `yaml:"name"`     // container name, default the repository name
+	Ports   []string          `yaml:"ports"`    // [ip:][host:]container[/proto]
+	Env     map[string]string `yaml:"env"`      // passed by name, values stay out of logs
+	EnvFile stringList        `yaml:"env_file"` // one file or a list
+	Volumes []string          `yaml:"volumes"`
+	Network string            `yaml:"network"`
+	Labels  map[string]string `yaml:"labels"`
+	Restart string            `yaml:"restart"` // no, always, unless-stopped, on-failure[:N]
+	CPUs    string            `yaml:"cpus"`    // e.g. "1.5"
+	Memory  string            `yaml:"memory"`  // e.g. 512m
+	Args    []string          `yaml:"args"`    // extra docker run arguments, before the image
+}
+
+// EnvironmentConfig holds the settings of one deployment environment. The
+// top-level environments registry defines which environments exist; the
+// environments section of a repository (or the defaults) adjusts them.
+type EnvironmentConfig struct {
+	Suffix    *string           `yaml:"suffix"`  // appended to the container name, default "-<name>"
+	Ports     []string          `yaml:"ports"`   // published ports of the container
+	Secrets   map[string]string `yaml:"secrets"` // container env with ${VAR} expansion, never logged
+	Notify    NotifyConfig      `yaml:"notify"`  // Discord channel of the environment
+	Container ContainerSpec     `yaml:"container"`
+	Strategy  string            `yaml:"strategy"` // recreate (default) or blue_green
+	BlueGreen BlueGreenConfig   `yaml:"blue_green"`
+	Readiness ReadinessCheck    `yaml:"readiness"` // applied over the repository's check
+	Watch     CrashWatch        `yaml:"watch"`     // applied over the repository's watch
+}
+
+// defaultEnvironments is the registry used when the pipeline file has none.
+// It matches the layout deployments had before environments were named.
+func defaultEnvironments() map[string]EnvironmentConfig {
+	none, staging := "", "-staging"
+	return map[string]EnvironmentConfig{
+		"production": {Suffix: &none, Ports: []string{"8100:8100"}},
+		"staging":    {Suffix: &staging, Ports: []string{"8101:8100"}},
+	}
+}
+
+// merge returns e with the settings of over applied on top
+func (e EnvironmentConfig) merge(over EnvironmentConfig) EnvironmentConfig {
+	if over.Suffix != nil {
+		e.Suffix = over.Suffix
+	}
+	if over.Ports != nil {
+		e.Ports = over.Ports
+	}
+	e.Secrets = mergeMaps(e.Secrets, over.Secrets)
+	e.Notify.DiscordWebhook = firstNonEmpty(over.Notify.DiscordWebhook, e.Notify.DiscordWebhook)
+	if over.Notify.Enabled != nil {
+		e.Notify.Enabled = over.Notify.Enabled
+	}
+	e.Container = e.Container.merge(over.Container)
+	e.Strategy = firstNonEmpty(over.Strategy, e.Strategy)
+	e.BlueGreen = e.BlueGreen.merge(over.BlueGreen)
+	e.Readiness = e.Readiness.merge(over.Readiness)
+	e.Watch = e.Watch.merge(over.Watch)
+	return e
+}
+
+// validate reports the mistakes in an environment section
+func (e EnvironmentConfig) validate(where string) []error {
+	var errs []error
+	if e.Suffix != nil && !suffixPattern.MatchString(*e.Suffix) {
+		errs = append(errs, fmt.Errorf("%s.suffix: %q may only contain letters, digits, '_', '.' and '-'", where, *e.Suffix))
+	}
+	for _, port := range e.Ports {
+		if !portPattern.MatchString(port) {
+			errs = append(errs, fmt.Errorf("%s.ports: invalid port mapping %q", where, port))
+		}
+	}
+	for name := range e.Secrets {
+		if !envNamePattern.MatchString(name) {
+			errs = append(errs, fmt.Errorf("%s.secrets: invalid variable name %q", where, name))
+		}
+	}
+	if e.Notify.DiscordWebhook != "" {
+		if err := checkWebhookURL(e.Notify.DiscordWebhook); err != nil {
+			errs = append(errs, fmt.Errorf("%s.notify.discord_webhook: %w", where, err))
+		}
+	}
+	if e.Strategy != "" && e.Strategy != strategyRecreate && e.Strategy != strategyBlueGreen {
+		errs = append(errs, fmt.Errorf("%s.strategy: %q is not recreate or blue_green", where, e.Strategy))
+	}
+	errs = append(errs, e.BlueGreen.validate(where+".blue_green")...)
+	errs = append(errs, e.Readiness.validate(where+".readiness")...)
+	errs = append(errs, e.Watch.validate(where+".watch")...)
+	return append(errs, e.Container.validate(where+".container")...)
+}
+
+func expandEnvironments(envs map[string]EnvironmentConfig) map[string]EnvironmentConfig {
+	for name, env := range envs {
+		envs[name] = env.expandEnv()
+	}
+	return envs
+}
+
+// expandEnv expands ${VAR} in the secret-bearing fields
+func (e EnvironmentConfig) expandEnv() EnvironmentConfig {
+	if len(e.Secrets) > 0 {
+		secrets := make(map[string]string, len(e.Secrets))
+		for k, v := range e.Secrets {
+			secrets[k] = os.ExpandEnv(v)
+		}
+		e.Secrets = secrets
+	}
+	e.Notify.DiscordWebhook = os.ExpandEnv(e.Notify.DiscordWebhook)
+	return e
+}
+
+// stringList is a YAML list that may also be written as a single string
+type stringList []string
+
+func (l *stringList) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*l = stringList{value.Value}
+		return nil
+	}
+	var list []string
+	if err := value.Decode(&list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+// merge returns c with every field that is set in over replacing it. Env and
+// labels are merged key by key.
+func (c ContainerSpec) merge(over ContainerSpec) ContainerSpec {
+	c.Name = firstNonEmpty(over.Name, c.Name)
+	c.Network = firstNonEmpty(over.Network, c.Network)
+	c.Restart = firstNonEmpty(over.Restart, c.Restart)
+	c.CPUs = firstNonEmpty(over.CPUs, c.CPUs)
+	c.Memory = firstNonEmpty(over.Memory, c.Memory)
+	if over.Ports != nil {
+		c.Ports = over.Ports
+	}
+	if over.EnvFile != nil {
+		c.EnvFile = over.EnvFile
+	}
+	if over.Volumes != nil {
+		c.Volumes = over.Volumes
+	}
+	if over.Args != nil {
+		c.Args = over.Args
+	}
+	c.Env = mergeMaps(c.Env, over.Env)
+	c.Labels = mergeMaps(c.Labels, over.Labels)
+	return c
+}
+
+func mergeMaps(base, over map[string]string) map[string]string {
+	if len(over) == 0 {
+		return base
+	}
+	merged := make(map[string]string, len(base)+len(over))
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range over {
+		merged[k] = v
+	}
+	return merged
+}
+
+// mergeEnvironments merges two environment maps entry by entry
+func mergeEnvironments(base, over map[string]EnvironmentConfig) map[string]EnvironmentConfig {
+	if len(over) == 0 {
+		return base
+	}
+	merged := make(map[string]EnvironmentConfig, len(base)+len(over))
+	for name, env := range base {
+		merged[name] = env
+	}
+	for name, env := range over {
+		merged[name] = merged[name].merge(env)
+	}
+	return merged
+}
+
+// containerSpec resolves the container of a repository in a resolved
+// environment (see Config.environment). The container is named after the
+// repository plus the environment suffix; the repository's container
+// section applies over that, then the environment's ports, container
+// section and secrets.
+func (rc RepoConfig) containerSpec(repoName, envName string, env EnvironmentConfig) ContainerSpec {
+	suffix := "-" + envName
+	if env.Suffix != nil {
+		suffix = *env.Suffix
+	}
+	spec := ContainerSpec{Name: repoName + suffix}.merge(rc.Container)
+	spec = spec.merge(ContainerSpec{Ports: env.Ports}).merge(env.Container)
+	return spec.merge(ContainerSpec{Env: env.Secrets})
+}
+
+// runCommand builds the docker run command line for image. Env values are
+// returned separately so they reach docker through its environment and never
+// show up in logs, plans or deployment records.
+func (c ContainerSpec) runCommand(image string) (string, map[string]string) {
+	args := []string{"docker", "run", "-d", "--name", c.Name}
+	for _, port := range c.Ports {
+		args = append(args, "-p", port)
+	}
+	for _, name := range sortedKeys(c.Env) {
+		args = append(args, "-e", name)
+	}
+	for _, file := range c.EnvFile {
+		args = append(args, "--env-file", file)
+	}
+	for _, volume := range c.Volumes {
+		args = append(args, "-v", volume)
+	}
+	if c.Network != "" {
+		args = append(args, "--network", c.Network)
+	}
+	for _, name := range sortedKeys(c.Labels) {
+		args = append(args, "--label", name+"="+c.Labels[name])
+	}
+	if c.Restart != "" {
+		args = append(args, "--restart", c.Restart)
+	}
+	if c.CPUs != "" {
+		args = append(args, "--cpus", c.CPUs)
+	}
+	if c.Memory != "" {
+		args = append(args, "--memory", c.Memory)
+	}
+	args = append(args, c.Args...)
+	args = append(args, image)
+
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " "), c.Env
+}
+
+// validate reports the mistakes in a (possibly partial) spec
+func (c ContainerSpec) validate(where string) []error {
+	var errs []error
+	if c.Name != "" && !containerNamePattern.MatchString(c.Name) {
+		errs = append(errs, fmt.Errorf("%s.name: %q is not a valid container name", where, c.Name))
+	}
+	for _, port := range c.Ports {
+		if !portPattern.MatchString(port) {
+			errs = append(errs, fmt.Errorf("%s.ports: invalid port mapping %q", where, port))
+		}
+	}
+	for name := range c.Env {
+		if !envNamePattern.MatchString(name) {
+			errs = append(errs, fmt.Errorf("%s.env: invalid variable name %q", where, name))
+		}
+	}
+	for _, volume := range c.Volumes {
+		if volume == "" || strings.HasPrefix(volume, "-") {
+			errs = append(errs, fmt.Errorf("%s.volumes: invalid volume %q", where, volume))
+		}
+	}
+	for name := range c.Labels {
+		if name == "" || strings.ContainsAny(name, "= ") {
+			errs = append(errs, fmt.Errorf("%s.labels: invalid label name %q", where, name))
+		}
+	}
+	if c.Restart != "" && !restartPattern.MatchString(c.Restart) {
+		errs = append(errs, fmt.Errorf("%s.restart: %q is not one of no, always, unless-stopped, on-failure[:N]", where, c.Restart))
+	}
+	if c.CPUs != "" {
+		if n, err := strconv.ParseFloat(c.CPUs, 64); err != nil || n <= 0 {
+			errs = append(errs, fmt.Errorf("%s.cpus: %q is not a positive number", where, c.CPUs))
+		}
+	}
+	if c.Memory != "" && !memoryPattern.MatchString(c.Memory) {
+		errs = append(errs, fmt.Errorf("%s.memory: %q is not a size such as 512m or 2g", where, c.Memory))
+	}
+	return errs
+}
+
+// environmentNames returns the configured environments in a stable order
+func environmentNames(envs map[string]EnvironmentConfig) []string {
+	names := make([]string, 0, len(envs))
+	for name := range envs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// deploymentView is the API representation of a deployment. Its fields
+// shadow the ones of deployJob that should be omitted when unset.
+type deploymentView struct {
+	deployJob
+	Payload    *WebhookPayload `json:"payload,omitempty"`
+	NotBefore  *time.Time      `json:"not_before,omitempty"`
+	StartedAt  *time.Time      `json:"started_at,omitempty"`
+	FinishedAt *time.Time      `json:"finished_at,omitempty"`
+	DurationMs int64           `json:"duration_ms,omitempty"`
+}
+
+// newDeploymentView converts a job; the payload is only included on request
+// because it makes listings very long.
+func newDeploymentView(job deployJob, withPayload bool) deploymentView {
+	view := deploymentView{deployJob: job}
+	if withPayload {
+		view.Payload = &job.Payload
+	}
+	if job.State == jobQueued && job.NotBefore.After(time.Now()) {
+		view.NotBefore = &job.NotBefore
+	}
+	if !job.StartedAt.IsZero() {
+		view.StartedAt = &job.StartedAt
+	}
+	if !job.FinishedAt.IsZero() {
+		view.FinishedAt = &job.FinishedAt
+	}
+	switch {
+	case !job.FinishedAt.IsZero() && !job.StartedAt.IsZero():
+		view.DurationMs = job.FinishedAt.Sub(job.StartedAt).Milliseconds()
+	case !job.StartedAt.IsZero():
+		view.DurationMs = time.Since(job.StartedAt).Milliseconds()
+	}
+	return view
+}
+
+// apiAuthMiddleware protects the deployment API with the bearer token from
+// server.api_token / API_TOKEN. Without a token the API is disabled, since
+// deployment output may contain secrets.
+func apiAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := getConfig().APIToken
+		if token == "" {
+			writeJSON(w, http.StatusForbidden, map[string]string{
+				"error": "Deployment API is disabled, set API_TOKEN to enable it",
+			})
+			return
+		}
+
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			log.Printf("Unauthorized API request from %s", getClientIP(r))
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "Invalid API token"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func getDeploymentHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := jobQueue.lookup(mux.Vars(r)["id"])
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "Deployment not found"})
+		return
+	}
+	writeJSON(w, http.StatusOK, newDeploymentView(job, true))
+}
+
+func listDeploymentsHandler(w http.ResponseWriter, r *http.Request) {
+	jobs := jobQueue.list(r.URL.Query().Get("repo"), r.URL.Query().Get("env"))
+	views := make([]deploymentView, 0, len(jobs))
+	for _, job := range jobs {
+		views = append(views, newDeploymentView(job, false))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"deployments": views,
+	})
+}
+
+func cancelDeploymentHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if _, ok := jobQueue.lookup(id); !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "Deployment not found"})
+		return
+	}
+
+	job, err := jobQueue.cancel(id)
+	if err != nil {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return
+	}
+	log.Printf("Deployment %s of %s cancelled via API", job.ID, job.Repository)
+	writeJSON(w, http.StatusOK, newDeploymentView(job, false))
+}
+
+// redeployHandler queues the payload of a successful deployment again
+func redeployHandler(w http.ResponseWriter, r *http.Request) {
+	source, ok := jobQueue.lookup(mux.Vars(r)["id"])
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "Deployment not found"})
+		return
+	}
+	if source.State != jobSucceeded {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "only successful deployments can be redeployed"})
+		return
+	}
+	queueAgain(w, source, "redeploy")
+}
+
+// rollbackHandler queues an earlier successful deployment of an environment
+// again: the one named by ?to= (a deployment id or a versioned tag), or else
+// the newest one that deployed a different image than the current release
+func rollbackHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	repo, env, to := vars["repo"], vars["env"], r.URL.Query().Get("to")
+
+	current, _ := lastRelease(jobQueue.store, strings.ToLower(repo)+"|"+env)
+	var target, unpinned *deployJob // unpinned: the newest earlier deployment without an image
+	for _, job := range jobQueue.list(repo, env) {
+		if job.State != jobSucceeded {
+			continue
+		}
+		rel := newRelease(job)
+		if rel.Image == "" && job.ID != current.DeploymentID && unpinned == nil {
+			earlier := job
+			unpinned = &earlier
+		}
+		match := job.ID != current.DeploymentID && rel.Image != current.Image
+		if to != "" {
+			match = job.ID == to || rel.Version == to || imageTag(job.Payload.Docker.VersionedImage) == to
+		}
+		if match {
+			target = &job
+			break
+		}
+	}
+
+	switch {
+	case target == nil && to != "":
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("no successful deployment of %s (%s) matches %q", repo, env, to)})
+	case target == nil && unpinned != nil:
+		writeJSON(w, http.StatusConflict, map[string]string{"error": fmt.Sprintf("deployment %s has no pinned image to roll back to, use redeploy", unpinned.ID)})
+	case target == nil:
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("no earlier successful deployment of %s (%s) to roll back to", repo, env)})
+	case newRelease(*target).Image == "":
+		writeJSON(w, http.StatusConflict, map[string]string{"error": fmt.Sprintf("deployment %s has no pinned image to roll back to, use redeploy", target.ID)})
+	default:
+		queueAgain(w, *target, "rollback")
+	}
+}
+
+// imageTag returns the tag of an image reference, "" if it has none
+func imageTag(image string) string {
+	ref, err := parseImageRef(image)
+	if err != nil || image == "" {
+		return ""
+	}
+	return ref.Tag
+}
+
+// queueAgain queues a new deployment with the payload of source. Docker
+// images are pinned the way releases are, so the same image is deployed even
+// if its tag has moved on since.
+func queueAgain(w http.ResponseWriter, source deployJob, trigger string) {
+	config := getConfig()
+	payload := source.Payload
+	if rel := newRelease(source); rel.Image != "" {
+		payload = rel.payload()
+	}
+
+	// The configuration may have changed since the payload was accepted
+	if source.PayloadType == "workflow" {
+		err := config.checkEnvironment(payload.Deployment.Environment)
+		if err == nil {
+			_, err = workflowImage(config, payload)
+		}
+		if err != nil {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": fmt.Sprintf("cannot %s %s: %v", trigger, source.ID, err)})
+			return
+		}
+	}
+
+	job := &deployJob{
+		ID:          newJobID(),
+		Repository:  source.Repository,
+		Environment: source.Environment,
+		Provider:    source.Provider,
+		PayloadType: source.PayloadType,
+		Payload:     payload,
+		Commit:      source.Commit,
+		Trigger:     trigger,
+		SourceID:    source.ID,
+	}
+	if err := jobQueue.enqueue(job); err != nil {
+		status := queueErrorStatus(err)
+		if status != http.StatusInternalServerError {
+			w.Header().Set("Retry-After", strconv.Itoa(int(config.Queue.RetryAfter.Seconds())))
+		}
+		writeJSON(w, status, map[string]string{"error": err.Error()})
+		return
+	}
+	log.Printf("Queued %s %s of %s (%s) from deployment %s", trigger, job.ID, job.Repository, job.Environment, source.ID)
+
+	w.Header().Set("Location", "/deployments/"+job.ID)
+	writeJSON(w, http.StatusAccepted, map[string]string{
+		"status":        "accepted",
+		"trigger":       trigger,
+		"source_id":     source.ID,
+		"deployment_id": job.ID,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,656 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Engine API version the client speaks (Docker 20.10 and later)
+const dockerAPIVersion = "v1.41"
+
+const defaultDockerHost = "unix:///var/run/docker.sock"
+
+// dockerError is an error response of the Docker Engine API
+type dockerError struct {
+	Op      string // what was attempted, e.g. "stop api"
+	Status  int    // HTTP status, 0 for errors reported inside a stream
+	Message string
+}
+
+func (e *dockerError) Error() string {
+	if e.Status == 0 {
+		return fmt.Sprintf("docker %s: %s", e.Op, e.Message)
+	}
+	return fmt.Sprintf("docker %s: %s (HTTP %d)", e.Op, e.Message, e.Status)
+}
+
+func isDockerNotFound(err error) bool {
+	var de *dockerError
+	return errors.As(err, &de) && de.Status == http.StatusNotFound
+}
+
+// dockerClient is a minimal Docker Engine API client. Host is a
+// unix:///path/to/socket or tcp://host:port address, as in DOCKER_HOST.
+type dockerClient struct {
+	host string
+	base string // URL prefix of every request
+	http *http.Client
+}
+
+var dockerClients sync.Map // host -> *dockerClient, so connections are reused
+
+func dockerClientFor(host string) (*dockerClient, error) {
+	if c, ok := dockerClients.Load(host); ok {
+		return c.(*dockerClient), nil
+	}
+	c, err := newDockerClient(host)
+	if err != nil {
+		return nil, err
+	}
+	actual, _ := dockerClients.LoadOrStore(host, c)
+	return actual.(*dockerClient), nil
+}
+
+func newDockerClient(host string) (*dockerClient, error) {
+	c := &dockerClient{host: host}
+	switch {
+	case strings.HasPrefix(host, "unix://"):
+		socket := strings.TrimPrefix(host, "unix://")
+		c.base = "http://docker/" + dockerAPIVersion
+		c.http = &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}}
+	case strings.HasPrefix(host, "tcp://"):
+		c.base = "http://" + strings.TrimPrefix(host, "tcp://") + "/" + dockerAPIVersion
+		c.http = &http.Client{}
+	default:
+		return nil, fmt.Errorf("unsupported docker host %q (expected unix:// or tcp://)", host)
+	}
+	return c, nil
+}
+
+// do sends a request and turns error responses into a *dockerError. The
+// caller closes the body of a successful response.
+func (c *dockerClient) do(ctx context.Context, op, method, path string, query url.Values, body interface{}, header http.Header) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	u := c.base + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, reader)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("docker %s: cannot reach %s: %w", op, c.host, err)
+	}
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		var msg struct {
+			Message string `json:"message"`
+		}
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		if json.Unmarshal(data, &msg) != nil || msg.Message == "" {
+			msg.Message = strings.TrimSpace(string(data))
+		}
+		return nil, &dockerError{Op: op, Status: resp.StatusCode, Message: msg.Message}
+	}
+	return resp, nil
+}
+
+// call is do for requests whose response is decoded into out (if not nil)
+func (c *dockerClient) call(ctx context.Context, op, method, path string, query url.Values, body, out interface{}) error {
+	resp, err := c.do(ctx, op, method, path, query, body, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// pullImage pulls ref, reporting progress to out one line per layer status
+// change. Errors inside the progress stream are returned as *dockerError.
+func (c *dockerClient) pullImage(ctx context.Context, ref imageRef, out io.Writer) error {
+	op := "pull " + ref.String()
+	query := url.Values{"fromImage": {ref.Repository()}, "tag": {ref.Tag}}
+	if ref.Digest != "" {
+		query.Set("tag", ref.Digest)
+	}
+	header := http.Header{}
+	if auth := registryAuth(ref.Registry); auth != "" {
+		header.Set("X-Registry-Auth", auth)
+	}
+
+	resp, err := c.do(ctx, op, http.MethodPost, "/images/create", query, nil, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Download and extract progress updates many times per layer; only
+	// status changes are worth a log line
+	last := make(map[string]string)
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var msg struct {
+			ID          string `json:"id"`
+			Status      string `json:"status"`
+			Error       string `json:"error"`
+			ErrorDetail struct {
+				Message string `json:"message"`
+			} `json:"errorDetail"`
+		}
+		if err := dec.Decode(&msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("docker %s: reading progress: %w", op, err)
+		}
+		if msg.Error != "" {
+			return &dockerError{Op: op, Message: firstNonEmpty(msg.ErrorDetail.Message, msg.Error)}
+		}
+		if msg.Status == "" || last[msg.ID] == msg.Status {
+			continue
+		}
+		last[msg.ID] = msg.Status
+		if msg.ID != "" {
+			fmt.Fprintf(out, "%s: %s\n", msg.ID, msg.Status)
+		} else {
+			fmt.Fprintln(out, msg.Status)
+		}
+	}
+}
+
+type dockerImage struct {
+	ID          string   `json:"Id"`
+	RepoDigests []string `json:"RepoDigests"`
+}
+
+func (c *dockerClient) inspectImage(ctx context.Context, ref imageRef) (dockerImage, error) {
+	var image dockerImage
+	err := c.call(ctx, "inspect image "+ref.String(), http.MethodGet, "/images/"+ref.String()+"/json", nil, nil, &image)
+	return image, err
+}
+
+// repoDigest returns the registry digest of the image for ref's repository
+func (image dockerImage) repoDigest(ref imageRef) string {
+	for _, d := range image.RepoDigests {
+		name, digest, ok := strings.Cut(d, "@")
+		if parsed, err := parseImageRef(name); ok && err == nil && parsed.Repository() == ref.Repository() {
+			return digest
+		}
+	}
+	return ""
+}
+
+// dockerContainer is the part of a container inspection the deployer uses
+type dockerContainer struct {
+	ID           string `json:"Id"`
+	Name         string `json:"Name"`
+	Image        string `json:"Image"`
+	RestartCount int    `json:"RestartCount"`
+	State        struct {
+		Status     string `json:"Status"` // created, running, restarting, exited, ...
+		Running    bool   `json:"Running"`
+		Restarting bool   `json:"Restarting"`
+		OOMKilled  bool   `json:"OOMKilled"`
+		ExitCode   int    `json:"ExitCode"`
+		Error      string `json:"Error"`
+		Health     *struct {
+			Status string `json:"Status"` // starting, healthy, unhealthy
+		} `json:"Health"`
+	} `json:"State"`
+	Config struct {
+		Image  string            `json:"Image"`
+		Labels map[string]string `json:"Labels"`
+	} `json:"Config"`
+	NetworkSettings struct {
+		IPAddress string `json:"IPAddress"` // on the default bridge network
+		Networks  map[string]struct {
+			IPAddress string `json:"IPAddress"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+// address returns the IP of the container on a network ("" for the network
+// it was started on)
+func (c dockerContainer) address(network string) string {
+	if n, ok := c.NetworkSettings.Networks[network]; ok {
+		return n.IPAddress
+	}
+	if network == "" {
+		for _, n := range c.NetworkSettings.Networks {
+			if n.IPAddress != "" {
+				return n.IPAddress
+			}
+		}
+	}
+	return c.NetworkSettings.IPAddress
+}
+
+func (c *dockerClient) inspectContainer(ctx context.Context, name string) (dockerContainer, error) {
+	var container dockerContainer
+	err := c.call(ctx, "inspect "+name, http.MethodGet, "/containers/"+url.PathEscape(name)+"/json", nil, nil, &container)
+	return container, err
+}
+
+// stopContainer stops a container; stopping a stopped one is not an error
+func (c *dockerClient) stopContainer(ctx context.Context, name string) error {
+	return c.call(ctx, "stop "+name, http.MethodPost, "/containers/"+url.PathEscape(name)+"/stop", nil, nil, nil)
+}
+
+func (c *dockerClient) removeContainer(ctx context.Context, name string) error {
+	return c.call(ctx, "rm "+name, http.MethodDelete, "/containers/"+url.PathEscape(name), url.Values{"force": {"true"}}, nil, nil)
+}
+
+// createContainer creates (but does not start) a container and returns its ID
+func (c *dockerClient) createContainer(ctx context.Context, name string, body containerCreate) (string, error) {
+	var created struct {
+		ID string `json:"Id"`
+	}
+	err := c.call(ctx, "create "+name, http.MethodPost, "/containers/create", url.Values{"name": {name}}, body, &created)
+	return created.ID, err
+}
+
+func (c *dockerClient) startContainer(ctx context.Context, id string) error {
+	return c.call(ctx, "start "+shortID(id), http.MethodPost, "/containers/"+id+"/start", nil, nil, nil)
+}
+
+// connectNetwork attaches a container to a network under extra DNS aliases
+func (c *dockerClient) connectNetwork(ctx context.Context, network, container string, aliases []string) error {
+	body := map[string]interface{}{
+		"Container":      container,
+		"EndpointConfig": map[string]interface{}{"Aliases": aliases},
+	}
+	return c.call(ctx, "network connect "+container, http.MethodPost, "/networks/"+url.PathEscape(network)+"/connect", nil, body, nil)
+}
+
+// containerLogs returns the last lines of a container's stdout and stderr
+func (c *dockerClient) containerLogs(ctx context.Context, name string, tail int) (string, error) {
+	query := url.Values{"stdout": {"1"}, "stderr": {"1"}, "tail": {strconv.Itoa(tail)}}
+	resp, err := c.do(ctx, "logs "+name, http.MethodGet, "/containers/"+url.PathEscape(name)+"/logs", query, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxStepOutput))
+	if err != nil {
+		return "", fmt.Errorf("docker logs %s: %w", name, err)
+	}
+	return demuxLogs(data), nil
+}
+
+// demuxLogs strips the 8-byte frame headers the API puts in front of the
+// stdout and stderr chunks of a container without a TTY. Output of a TTY
+// container has no headers and is returned as is.
+func demuxLogs(data []byte) string {
+	var out strings.Builder
+	for len(data) >= 8 && data[0] <= 2 && data[1] == 0 && data[2] == 0 && data[3] == 0 {
+		size := int(binary.BigEndian.Uint32(data[4:8]))
+		data = data[8:]
+		if size > len(data) {
+			size = len(data)
+		}
+		out.Write(data[:size])
+		data = data[size:]
+	}
+	out.Write(data)
+	return out.String()
+}
+
+func (c *dockerClient) disconnectNetwork(ctx context.Context, network, container string) error {
+	body := map[string]interface{}{"Container": container, "Force": true}
+	return c.call(ctx, "network disconnect "+container, http.MethodPost, "/networks/"+url.PathEscape(network)+"/disconnect", nil, body, nil)
+}
+
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+// containerCreate is the body of POST /containers/create
+type containerCreate struct {
+	Image        string              `json:"Image"`
+	Env          []string            `json:"Env,omitempty"`
+	Labels       map[string]string   `json:"Labels,omitempty"`
+	ExposedPorts map[string]struct{} `json:"ExposedPorts,omitempty"`
+	HostConfig   struct {
+		PortBindings  map[string][]portBinding `json:"PortBindings,omitempty"`
+		Binds         []string                 `json:"Binds,omitempty"`
+		NetworkMode   string                   `json:"NetworkMode,omitempty"`
+		RestartPolicy struct {
+			Name              string `json:"Name,omitempty"`
+			MaximumRetryCount int    `json:"MaximumRetryCount,omitempty"`
+		} `json:"RestartPolicy"`
+		NanoCPUs int64 `json:"NanoCpus,omitempty"`
+		Memory   int64 `json:"Memory,omitempty"`
+	} `json:"HostConfig"`
+}
+
+type portBinding struct {
+	HostIP   string `json:"HostIp,omitempty"`
+	HostPort string `json:"HostPort,omitempty"`
+}
+
+// createBody translates a container spec into an API request, the way the
+// docker CLI does for the equivalent docker run flags
+func (c ContainerSpec) createBody(image string) (containerCreate, error) {
+	body := containerCreate{Image: image, Labels: c.Labels}
+
+	for _, file := range c.EnvFile {
+		env, err := readEnvFile(file)
+		if err != nil {
+			return body, err
+		}
+		body.Env = append(body.Env, env...)
+	}
+	body.Env = append(body.Env, envList(c.Env)...)
+
+	for _, port := range c.Ports {
+		if err := body.addPort(port); err != nil {
+			return body, err
+		}
+	}
+	body.HostConfig.Binds = c.Volumes
+	body.HostConfig.NetworkMode = c.Network
+
+	if c.Restart != "" {
+		name, retries, _ := strings.Cut(c.Restart, ":")
+		body.HostConfig.RestartPolicy.Name = name
+		body.HostConfig.RestartPolicy.MaximumRetryCount, _ = strconv.Atoi(retries)
+	}
+	if c.CPUs != "" {
+		cpus, err := strconv.ParseFloat(c.CPUs, 64)
+		if err != nil {
+			return body, fmt.Errorf("cpus: %w", err)
+		}
+		body.HostConfig.NanoCPUs = int64(cpus * 1e9)
+	}
+	if c.Memory != "" {
+		memory, err := parseMemory(c.Memory)
+		if err != nil {
+			return body, err
+		}
+		body.HostConfig.Memory = memory
+	}
+	if len(c.Args) > 0 {
+		return body, fmt.Errorf("container.args are docker CLI flags and need the cli executor")
+	}
+	return body, nil
+}
+
+// addPort adds a [ip:][host:]container[/proto] mapping; ranges map port by port
+func (body *containerCreate) addPort(mapping string) error {
+	rest, proto, ok := strings.Cut(mapping, "/")
+	if !ok {
+		proto = "tcp"
+	}
+	var ip string
+	if strings.HasPrefix(rest, "[") {
+		end := strings.Index(rest, "]:")
+		if end < 0 {
+			return fmt.Errorf("invalid port mapping %q", mapping)
+		}
+		ip, rest = rest[1:end], rest[end+2:]
+	}
+	parts := strings.Split(rest, ":")
+	if len(parts) == 3 {
+		ip, parts = parts[0], parts[1:]
+	}
+	hostPorts, containerPorts := "", parts[len(parts)-1]
+	if len(parts) == 2 {
+		hostPorts = parts[0]
+	}
+
+	cFirst, cLast, err := portRange(containerPorts)
+	if err != nil {
+		return fmt.Errorf("invalid port mapping %q", mapping)
+	}
+	hFirst, hLast := 0, 0
+	if hostPorts != "" {
+		if hFirst, hLast, err = portRange(hostPorts); err != nil || hLast-hFirst != cLast-cFirst {
+			return fmt.Errorf("invalid port mapping %q", mapping)
+		}
+	}
+
+	if body.ExposedPorts == nil {
+		body.ExposedPorts = make(map[string]struct{})
+		body.HostConfig.PortBindings = make(map[string][]portBinding)
+	}
+	for i := 0; i <= cLast-cFirst; i++ {
+		key := fmt.Sprintf("%d/%s", cFirst+i, proto)
+		binding := portBinding{HostIP: ip}
+		if hostPorts != "" {
+			binding.HostPort = strconv.Itoa(hFirst + i)
+		}
+		body.ExposedPorts[key] = struct{}{}
+		body.HostConfig.PortBindings[key] = append(body.HostConfig.PortBindings[key], binding)
+	}
+	return nil
+}
+
+func portRange(s string) (int, int, error) {
+	first, last, isRange := strings.Cut(s, "-")
+	a, err := strconv.Atoi(first)
+	if err != nil {
+		return 0, 0, err
+	}
+	b := a
+	if isRange {
+		if b, err = strconv.Atoi(last); err != nil || b < a {
+			return 0, 0, fmt.Errorf("invalid port range %q", s)
+		}
+	}
+	return a, b, nil
+}
+
+// parseMemory converts a size such as 512m into bytes
+func parseMemory(s string) (int64, error) {
+	multiplier := int64(1)
+	switch strings.ToLower(s[len(s)-1:]) {
+	case "b":
+		s = s[:len(s)-1]
+	case "k":
+		multiplier, s = 1<<10, s[:len(s)-1]
+	case "m":
+		multiplier, s = 1<<20, s[:len(s)-1]
+	case "g":
+		multiplier, s = 1<<30, s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid memory size %q", s)
+	}
+	return n * multiplier, nil
+}
+
+// readEnvFile reads a docker --env-file: KEY=value lines, comments starting
+// with #, and bare KEY lines taking the value from the server's environment
+func readEnvFile(file string) ([]string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("env_file: %w", err)
+	}
+	var env []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		if !strings.Contains(line, "=") {
+			if value, ok := os.LookupEnv(strings.TrimSpace(line)); ok {
+				env = append(env, strings.TrimSpace(line)+"="+value)
+			}
+			continue
+		}
+		env = append(env, strings.TrimLeft(line, " \t"))
+	}
+	return env, nil
+}
+
+// registryAuth returns the X-Registry-Auth header for a registry from the
+// credentials "docker login" stored in the docker config file. Credential
+// helpers are not supported; the CLI executor handles those.
+func registryAuth(registry string) string {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".docker")
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "config.json"))
+	if err != nil {
+		return ""
+	}
+	var cfg struct {
+		Auths map[string]struct {
+			Auth string `json:"auth"`
+		} `json:"auths"`
+	}
+	if json.Unmarshal(data, &cfg) != nil {
+		return ""
+	}
+
+	for server, entry := range cfg.Auths {
+		host := server
+		if u, err := url.Parse(server); err == nil && u.Host != "" {
+			host = u.Host
+		}
+		if normalizeRegistry(host) != registry || entry.Auth == "" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+		if err != nil {
+			return ""
+		}
+		user, password, _ := strings.Cut(string(decoded), ":")
+		auth, _ := json.Marshal(map[string]string{"username": user, "password": password, "serveraddress": server})
+		return base64.URLEncoding.EncodeToString(auth)
+	}
+	return ""
+}
+
+// dockerAPISteps builds the steps of a Docker workflow for the Engine API
+// executor. Each step is shown as the equivalent docker command.
+func dockerAPISteps(host string, image imageRef, spec ContainerSpec, runCommand string) []Step {
+	client := func() (*dockerClient, error) { return dockerClientFor(host) }
+
+	// Stopping or removing a container that is not there is expected on the
+	// first deployment of an environment
+	removal := func(action func(*dockerClient, context.Context, string) error) stepFunc {
+		return func(ctx context.Context, out io.Writer, run *deployRun) error {
+			c, err := client()
+			if err != nil {
+				return err
+			}
+			err = action(c, ctx, spec.Name)
+			if isDockerNotFound(err) {
+				fmt.Fprintf(out, "No such container: %s\n", spec.Name)
+				return errNothingToDo
+			}
+			return err
+		}
+	}
+
+	start := func(ctx context.Context, out io.Writer, run *deployRun) error {
+		c, err := client()
+		if err != nil {
+			return err
+		}
+		body, err := spec.createBody(image.String())
+		if err != nil {
+			return err
+		}
+		id, err := c.createContainer(ctx, spec.Name, body)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Created container %s (%s)\n", spec.Name, shortID(id))
+		if err := c.startContainer(ctx, id); err != nil {
+			return err
+		}
+		container, err := c.inspectContainer(ctx, id)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Container %s is %s\n", spec.Name, container.State.Status)
+		return nil
+	}
+
+	return []Step{
+		pullStep(host, image),
+		{Run: fmt.Sprintf("docker stop %s", spec.Name), call: removal((*dockerClient).stopContainer), cutover: true},
+		{Run: fmt.Sprintf("docker rm %s", spec.Name), call: removal((*dockerClient).removeContainer)},
+		{Run: runCommand, call: start},
+	}
+}
+
+// pullStep pulls the image of a Docker workflow and reports its digest
+func pullStep(host string, image imageRef) Step {
+	pull := func(ctx context.Context, out io.Writer, run *deployRun) error {
+		c, err := dockerClientFor(host)
+		if err != nil {
+			return err
+		}
+		if err := c.pullImage(ctx, image, out); err != nil {
+			return err
+		}
+		inspected, err := c.inspectImage(ctx, image)
+		if err != nil {
+			return err
+		}
+		digest := inspected.repoDigest(image)
+		fmt.Fprintf(out, "Image: %s\nImage ID: %s\nDigest: %s\n", image, inspected.ID, firstNonEmpty(digest, "(none, image is not from a registry)"))
+		if run.onImage != nil {
+			run.onImage(image.String(), digest)
+		}
+		return nil
+	}
+	return Step{Run: fmt.Sprintf("docker pull %s", image), call: pull}
+}
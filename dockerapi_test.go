@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeEngine serves handler as a Docker Engine API on a unix socket and
+// returns the DOCKER_HOST style address of it
+func fakeEngine(t *testing.T, handler http.Handler) string {
+	t.Helper()
+	// t.TempDir paths can exceed the length limit of socket paths
+	dir, err := os.MkdirTemp("", "engine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	socket := filepath.Join(dir, "docker.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: handler}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+	return "unix://" + socket
+}
+
+func mustImageRef(t *testing.T, raw string) imageRef {
+	t.Helper()
+	ref, err := parseImageRef(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ref
+}
+
+func TestPullImageProgress(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/"+dockerAPIVersion+"/images/create", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("method = %s, want POST", r.Method)
+		}
+		if got := r.URL.Query().Get("fromImage"); got != "ghcr.io/company/api" {
+			t.Errorf("fromImage = %q", got)
+		}
+		if got := r.URL.Query().Get("tag"); got != "1.4.2" {
+			t.Errorf("tag = %q", got)
+		}
+		for _, line := range []string{
+			`{"status":"Pulling from company/api","id":"1.4.2"}`,
+			`{"status":"Downloading","progressDetail":{"current":1},"id":"a1b2"}`,
+			`{"status":"Downloading","progressDetail":{"current":2},"id":"a1b2"}`,
+			`{"status":"Pull complete","id":"a1b2"}`,
+			`{"status":"Status: Downloaded newer image for ghcr.io/company/api:1.4.2"}`,
+		} {
+			fmt.Fprintln(w, line)
+		}
+	})
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+
+	c, err := newDockerClient(fakeEngine(t, mux))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := c.pullImage(context.Background(), mustImageRef(t, "ghcr.io/company/api:1.4.2"), &out); err != nil {
+		t.Fatalf("pullImage: %v", err)
+	}
+
+	want := "1.4.2: Pulling from company/api\n" +
+		"a1b2: Downloading\n" +
+		"a1b2: Pull complete\n" +
+		"Status: Downloaded newer image for ghcr.io/company/api:1.4.2\n"
+	if out.String() != want {
+		t.Errorf("progress output:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
+
+func TestPullImageStreamError(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/"+dockerAPIVersion+"/images/create", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"status":"Pulling from company/api","id":"latest"}`)
+		fmt.Fprintln(w, `{"errorDetail":{"message":"manifest unknown: manifest unknown"},"error":"manifest unknown"}`)
+	})
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+
+	c, err := newDockerClient(fakeEngine(t, mux))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	err = c.pullImage(context.Background(), mustImageRef(t, "ghcr.io/company/api"), &out)
+
+	var de *dockerError
+	if !errors.As(err, &de) {
+		t.Fatalf("pullImage error = %v, want a *dockerError", err)
+	}
+	if de.Status != 0 || de.Message != "manifest unknown: manifest unknown" {
+		t.Errorf("dockerError = %+v", de)
+	}
+	if out.String() != "latest: Pulling from company/api\n" {
+		t.Errorf("progress output = %q", out.String())
+	}
+}
+
+func TestRemovalOfMissingContainer(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintln(w, `{"message":"No such container: api"}`)
+	})
+	host := fakeEngine(t, mux)
+
+	steps := dockerAPISteps(host, mustImageRef(t, "company/api:1.0"), ContainerSpec{Name: "api"}, "docker run company/api:1.0")
+	for _, step := range steps[1:3] {
+		var out bytes.Buffer
+		err := step.call(context.Background(), &out, &deployRun{})
+		if !errors.Is(err, errNothingToDo) {
+			t.Errorf("%s: error = %v, want errNothingToDo", step.Run, err)
+		}
+		if out.String() != "No such container: api\n" {
+			t.Errorf("%s: output = %q", step.Run, out.String())
+		}
+	}
+}
+
+func TestRemovalError(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, `{"message":"driver failed"}`)
+	})
+	host := fakeEngine(t, mux)
+
+	steps := dockerAPISteps(host, mustImageRef(t, "company/api:1.0"), ContainerSpec{Name: "api"}, "docker run company/api:1.0")
+	err := steps[1].call(context.Background(), &bytes.Buffer{}, &deployRun{})
+	var de *dockerError
+	if !errors.As(err, &de) || de.Status != http.StatusInternalServerError || de.Message != "driver failed" {
+		t.Errorf("stop error = %v, want the HTTP 500 as a *dockerError", err)
+	}
+}
+
+func TestCreateAndStartContainer(t *testing.T) {
+	const id = "0123456789abcdef0123"
+	var created containerCreate
+	started := false
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/"+dockerAPIVersion+"/containers/create", func(w http.ResponseWriter, r *http.Request) {
+		if got := r.URL.Query().Get("name"); got != "api" {
+			t.Errorf("create name = %q", got)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&created); err != nil {
+			t.Errorf("create body: %v", err)
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"Id":%q,"Warnings":[]}`, id)
+	})
+	mux.HandleFunc("/"+dockerAPIVersion+"/containers/"+id+"/start", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("start method = %s", r.Method)
+		}
+		started = true
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/"+dockerAPIVersion+"/containers/"+id+"/json", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"Id":%q,"Name":"/api","State":{"Status":"running","Running":true}}`, id)
+	})
+	host := fakeEngine(t, mux)
+
+	spec := ContainerSpec{Name: "api", Ports: []string{"8100:8100"}, Env: map[string]string{"MODE": "production"}}
+	steps := dockerAPISteps(host, mustImageRef(t, "company/api:1.0"), spec, "docker run company/api:1.0")
+	var out bytes.Buffer
+	if err := steps[3].call(context.Background(), &out, &deployRun{}); err != nil {
+		t.Fatalf("start step: %v", err)
+	}
+
+	if !started {
+		t.Error("container was not started")
+	}
+	if created.Image != "docker.io/company/api:1.0" {
+		t.Errorf("created image = %q", created.Image)
+	}
+	if !reflect.DeepEqual(created.Env, []string{"MODE=production"}) {
+		t.Errorf("created env = %q", created.Env)
+	}
+	if got := created.HostConfig.PortBindings["8100/tcp"]; len(got) != 1 || got[0].HostPort != "8100" {
+		t.Errorf("created port bindings = %v", created.HostConfig.PortBindings)
+	}
+	want := "Created container api (0123456789ab)\nContainer api is running\n"
+	if out.String() != want {
+		t.Errorf("output = %q, want %q", out.String(), want)
+	}
+}
+
+func TestAddPort(t *testing.T) {
+	tests := []struct {
+		mapping string
+		want    map[string][]portBinding
+	}{
+		{"8100", map[string][]portBinding{"8100/tcp": {{}}}},
+		{"8101:8100", map[string][]portBinding{"8100/tcp": {{HostPort: "8101"}}}},
+		{"127.0.0.1:8101:8100/udp", map[string][]portBinding{"8100/udp": {{HostIP: "127.0.0.1", HostPort: "8101"}}}},
+		{"[::1]:8101:8100", map[string][]portBinding{"8100/tcp": {{HostIP: "::1", HostPort: "8101"}}}},
+		{"9000-9002:8000-8002", map[string][]portBinding{
+			"8000/tcp": {{HostPort: "9000"}},
+			"8001/tcp": {{HostPort: "9001"}},
+			"8002/tcp": {{HostPort: "9002"}},
+		}},
+		{"7000-7001", map[string][]portBinding{"7000/tcp": {{}}, "7001/tcp": {{}}}},
+	}
+	for _, tt := range tests {
+		var body containerCreate
+		if err := body.addPort(tt.mapping); err != nil {
+			t.Errorf("addPort(%q): %v", tt.mapping, err)
+			continue
+		}
+		if !reflect.DeepEqual(body.HostConfig.PortBindings, tt.want) {
+			t.Errorf("addPort(%q) bindings = %v, want %v", tt.mapping, body.HostConfig.PortBindings, tt.want)
+		}
+		if len(body.ExposedPorts) != len(tt.want) {
+			t.Errorf("addPort(%q) exposed = %v", tt.mapping, body.ExposedPorts)
+		}
+	}
+
+	for _, mapping := range []string{"http", "9000-9001:8000-8002", "8002-8000", "[::1:8100", "a:8100"} {
+		var body containerCreate
+		if err := body.addPort(mapping); err == nil {
+			t.Errorf("addPort(%q) succeeded, want an error", mapping)
+		}
+	}
+}
+
+func TestCreateBody(t *testing.T) {
+	envFile := filepath.Join(t.TempDir(), "app.env")
+	if err := os.WriteFile(envFile, []byte("# database\nDB_HOST=db\n\nDB_PORT=5432\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	spec := ContainerSpec{
+		Ports:   []string{"8101:8100", "9000-9001:9000-9001/udp"},
+		Env:     map[string]string{"B": "2", "A": "1"},
+		EnvFile: stringList{envFile},
+		Volumes: []string{"/srv/data:/data"},
+		Network: "backend",
+		Restart: "on-failure:3",
+		CPUs:    "1.5",
+		Memory:  "512m",
+	}
+	body, err := spec.createBody("docker.io/company/api:1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"DB_HOST=db", "DB_PORT=5432", "A=1", "B=2"}; !reflect.DeepEqual(body.Env, want) {
+		t.Errorf("env = %q, want %q", body.Env, want)
+	}
+	if len(body.ExposedPorts) != 3 || body.HostConfig.PortBindings["9001/udp"][0].HostPort != "9001" {
+		t.Errorf("ports = %v", body.HostConfig.PortBindings)
+	}
+	hc := body.HostConfig
+	if hc.RestartPolicy.Name != "on-failure" || hc.RestartPolicy.MaximumRetryCount != 3 {
+		t.Errorf("restart policy = %+v", hc.RestartPolicy)
+	}
+	if hc.NanoCPUs != 1_500_000_000 || hc.Memory != 512<<20 {
+		t.Errorf("limits = %d nano CPUs, %d bytes", hc.NanoCPUs, hc.Memory)
+	}
+	if hc.NetworkMode != "backend" || !reflect.DeepEqual(hc.Binds, spec.Volumes) {
+		t.Errorf("network = %q, binds = %q", hc.NetworkMode, hc.Binds)
+	}
+
+	spec.Args = []string{"--init"}
+	if _, err := spec.createBody("docker.io/company/api:1.0"); err == nil {
+		t.Error("createBody accepted container.args")
+	}
+}
+
+func TestRegistryAuth(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("DOCKER_CONFIG", dir)
+	config := `{"auths":{
+		"https://index.docker.io/v1/":{"auth":"` + base64.StdEncoding.EncodeToString([]byte("hub:hub-pass")) + `"},
+		"ghcr.io":{"auth":"` + base64.StdEncoding.EncodeToString([]byte("bot:tok:en")) + `"},
+		"harbor.company.com":{}
+	}}`
+	if err := os.WriteFile(filepath.Join(dir, "config.json"), []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		registry string
+		want     map[string]string
+	}{
+		{"docker.io", map[string]string{"username": "hub", "password": "hub-pass", "serveraddress": "https://index.docker.io/v1/"}},
+		{"ghcr.io", map[string]string{"username": "bot", "password": "tok:en", "serveraddress": "ghcr.io"}},
+		{"harbor.company.com", nil},
+		{"quay.io", nil},
+	}
+	for _, tt := range tests {
+		header := registryAuth(tt.registry)
+		if tt.want == nil {
+			if header != "" {
+				t.Errorf("registryAuth(%q) = %q, want none", tt.registry, header)
+			}
+			continue
+		}
+		if strings.ContainsAny(header, "+/") {
+			t.Errorf("registryAuth(%q) = %q is not URL-safe base64", tt.registry, header)
+		}
+		data, err := base64.URLEncoding.DecodeString(header)
+		if err != nil {
+			t.Errorf("registryAuth(%q): %v", tt.registry, err)
+			continue
+		}
+		var got map[string]string
+		if err := json.Unmarshal(data, &got); err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("registryAuth(%q) = %s, want %v", tt.registry, data, tt.want)
+		}
+	}
+}
+
+func TestPullImageSendsRegistryAuth(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("DOCKER_CONFIG", dir)
+	auth := base64.StdEncoding.EncodeToString([]byte("bot:secret"))
+	if err := os.WriteFile(filepath.Join(dir, "config.json"), []byte(`{"auths":{"ghcr.io":{"auth":"`+auth+`"}}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var header string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/"+dockerAPIVersion+"/images/create", func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Get("X-Registry-Auth")
+	})
+	c, err := newDockerClient(fakeEngine(t, mux))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.pullImage(context.Background(), mustImageRef(t, "ghcr.io/company/api:1.0"), &bytes.Buffer{}); err != nil {
+		t.Fatal(err)
+	}
+	if header == "" || header != registryAuth("ghcr.io") {
+		t.Errorf("X-Registry-Auth = %q, want %q", header, registryAuth("ghcr.io"))
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// giteaProvider handles Gitea and Forgejo push and release webhooks. Both
+// sign the body like GitHub, but send the hex HMAC without the sha256=
+// prefix; Forgejo sends its own headers next to the Gitea ones.
+type giteaProvider struct{}
+
+type giteaUser struct {
+	Login    string `json:"login"`
+	FullName string `json:"full_name"`
+	Email    string `json:"email"`
+}
+
+// giteaPayload covers the fields the push and release events use
+type giteaPayload struct {
+	Ref        string `json:"ref"`
+	After      string `json:"after"`
+	Repository struct {
+		Name     string `json:"name"`
+		FullName string `json:"full_name"`
+		HTMLURL  string `json:"html_url"`
+	} `json:"repository"`
+	HeadCommit *struct {
+		ID      string `json:"id"`
+		Message string `json:"message"`
+		URL     string `json:"url"`
+	} `json:"head_commit"`
+	Pusher  giteaUser `json:"pusher"`
+	Sender  giteaUser `json:"sender"`
+	Action  string    `json:"action"` // release: published, updated or deleted
+	Release struct {
+		TagName string `json:"tag_name"`
+		Name    string `json:"name"`
+		HTMLURL string `json:"html_url"`
+		Draft   bool   `json:"draft"`
+	} `json:"release"`
+}
+
+// SHA of the "after" commit of a push that deleted its ref
+const nullSHA = "0000000000000000000000000000000000000000"
+
+func (giteaProvider) name() string { return "gitea" }
+
+func (giteaProvider) match(r *http.Request, body []byte) bool {
+	return giteaHeader(r, "Event") != ""
+}
+
+// giteaHeader reads X-Gitea-<name>, or X-Forgejo-<name> from Forgejo
+// versions that dropped the Gitea headers
+func giteaHeader(r *http.Request, name string) string {
+	return firstNonEmpty(r.Header.Get("X-Gitea-"+name), r.Header.Get("X-Forgejo-"+name))
+}
+
+func (giteaProvider) authenticate(r *http.Request, body []byte, config *Config) error {
+	signature := giteaHeader(r, "Signature")
+	if signature == "" {
+		return errors.New("no X-Gitea-Signature header")
+	}
+	if !checkSignature(body, signature, config.GiteaSecret) {
+		return errInvalidSignature
+	}
+	return nil
+}
+
+func (p giteaProvider) parse(r *http.Request, body []byte) (deployEvent, error) {
+	var payload giteaPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return deployEvent{}, fmt.Errorf("invalid JSON payload: %w", err)
+	}
+	if payload.Repository.FullName == "" {
+		return deployEvent{}, errors.New("payload has no repository.full_name")
+	}
+	event := deployEvent{
+		Provider:   p.name(),
+		Type:       "push",
+		Repository: payload.Repository.FullName,
+		DeliveryID: giteaHeader(r, "Delivery"),
+	}
+
+	// Both events deploy like a GitHub push, so they share its embed
+	out := &event.Payload
+	switch eventType := giteaHeader(r, "Event"); eventType {
+	case "push":
+		if payload.After == nullSHA {
+			return event, ignoreEvent(fmt.Sprintf("%s deleted", payload.Ref))
+		}
+		event.Ref = payload.Ref
+		event.Commit = payload.After
+		event.Author = firstNonEmpty(payload.Pusher.FullName, payload.Pusher.Login, payload.Sender.Login)
+		out.HeadCommit.ID = payload.After
+		out.HeadCommit.URL = payload.Repository.HTMLURL + "/commit/" + payload.After
+		if c := payload.HeadCommit; c != nil && c.ID != "" {
+			event.Commit = c.ID
+			out.HeadCommit.ID, out.HeadCommit.Message = c.ID, c.Message
+			out.HeadCommit.URL = firstNonEmpty(c.URL, out.HeadCommit.URL)
+		}
+	case "release":
+		release := payload.Release
+		if payload.Action != "published" || release.Draft {
+			return event, ignoreEvent(fmt.Sprintf("Release %s %s, only published releases deploy", release.TagName, payload.Action))
+		}
+		event.Ref = "refs/tags/" + release.TagName
+		event.Commit = release.TagName
+		event.Author = firstNonEmpty(payload.Sender.FullName, payload.Sender.Login)
+		out.HeadCommit.ID = release.TagName
+		out.HeadCommit.Message = firstNonEmpty(release.Name, release.TagName)
+		out.HeadCommit.URL = release.HTMLURL
+	default:
+		return event, ignoreEvent(fmt.Sprintf("Unsupported Gitea event %q", eventType))
+	}
+
+	out.Repository.Name = payload.Repository.Name
+	out.Repository.FullName = payload.Repository.FullName
+	out.Repository.HTMLURL = payload.Repository.HTMLURL
+	out.Ref = event.Ref
+	out.Pusher.Name = event.Author
+	out.Pusher.Email = payload.Pusher.Email
+	out.Sender.Login = payload.Sender.Login
+	return event, nil
+}
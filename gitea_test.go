@@ -0,0 +1,198 @@
+package main
+
+import "testing"
+
+// Trimmed from a Gitea 1.21 push webhook
+const giteaPushHook = `{
+  "ref": "refs/heads/main",
+  "before": "28e1879d029cb852e4844d9c718537df08844e03",
+  "after": "bffeb74224043ba2feb48d137756c8a9331c449a",
+  "compare_url": "https://gitea.example.com/gitea/webhooks/compare/28e1879d029cb852e4844d9c718537df08844e03...bffeb74224043ba2feb48d137756c8a9331c449a",
+  "commits": [
+    {
+      "id": "bffeb74224043ba2feb48d137756c8a9331c449a",
+      "message": "Webhooks Yay!",
+      "url": "https://gitea.example.com/gitea/webhooks/commit/bffeb74224043ba2feb48d137756c8a9331c449a",
+      "author": {"name": "Gitea", "email": "someone@gitea.io", "username": "gitea"}
+    }
+  ],
+  "head_commit": {
+    "id": "bffeb74224043ba2feb48d137756c8a9331c449a",
+    "message": "Webhooks Yay!",
+    "url": "https://gitea.example.com/gitea/webhooks/commit/bffeb74224043ba2feb48d137756c8a9331c449a"
+  },
+  "repository": {
+    "id": 140,
+    "name": "webhooks",
+    "full_name": "gitea/webhooks",
+    "html_url": "https://gitea.example.com/gitea/webhooks",
+    "private": false,
+    "default_branch": "main"
+  },
+  "pusher": {"id": 1, "login": "gitea", "full_name": "Gitea", "email": "someone@gitea.io"},
+  "sender": {"id": 1, "login": "gitea", "full_name": "Gitea", "email": "someone@gitea.io"}
+}`
+
+const giteaReleaseHook = `{
+  "action": "published",
+  "release": {
+    "id": 12,
+    "tag_name": "v1.2.0",
+    "target_commitish": "main",
+    "name": "Version 1.2",
+    "html_url": "https://gitea.example.com/gitea/webhooks/releases/tag/v1.2.0",
+    "draft": false,
+    "prerelease": false
+  },
+  "repository": {
+    "name": "webhooks",
+    "full_name": "gitea/webhooks",
+    "html_url": "https://gitea.example.com/gitea/webhooks"
+  },
+  "sender": {"id": 1, "login": "gitea", "full_name": "Gitea", "email": "someone@gitea.io"}
+}`
+
+func TestGiteaAuthenticate(t *testing.T) {
+	cfg := loadTestConfig(t, "server: {secret: webhook-secret, gitea_secret: gitea-secret}\n")
+	tests := []struct {
+		name   string
+		header []string
+		ok     bool
+	}{
+		{"gitea signature", []string{"X-Gitea-Event: push", "X-Gitea-Signature: " + hmacHex("gitea-secret", giteaPushHook)}, true},
+		{"forgejo signature", []string{"X-Forgejo-Event: push", "X-Forgejo-Signature: " + hmacHex("gitea-secret", giteaPushHook)}, true},
+		{"prefixed signature", []string{"X-Gitea-Event: push", "X-Gitea-Signature: sha256=" + hmacHex("gitea-secret", giteaPushHook)}, true},
+		{"wrong secret", []string{"X-Gitea-Event: push", "X-Gitea-Signature: " + hmacHex("wrong", giteaPushHook)}, false},
+		{"server secret", []string{"X-Gitea-Event: push", "X-Gitea-Signature: " + hmacHex("webhook-secret", giteaPushHook)}, false},
+		{"other body", []string{"X-Gitea-Event: push", "X-Gitea-Signature: " + hmacHex("gitea-secret", giteaReleaseHook)}, false},
+		{"missing signature", []string{"X-Gitea-Event: push"}, false},
+	}
+	for _, tt := range tests {
+		r := newWebhook(giteaPushHook, tt.header...)
+		err := giteaProvider{}.authenticate(r, []byte(giteaPushHook), cfg)
+		if tt.ok && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if !tt.ok && err == nil {
+			t.Errorf("%s: accepted", tt.name)
+		}
+	}
+
+	// Without gitea_secret the server secret signs Gitea webhooks
+	cfg = loadTestConfig(t, "server: {secret: webhook-secret}\n")
+	r := newWebhook(giteaPushHook, "X-Gitea-Event: push", "X-Gitea-Signature: "+hmacHex("webhook-secret", giteaPushHook))
+	if err := (giteaProvider{}).authenticate(r, []byte(giteaPushHook), cfg); err != nil {
+		t.Errorf("server secret fallback: %v", err)
+	}
+}
+
+func TestGiteaParse(t *testing.T) {
+	cfg := loadTestConfig(t, "server: {secret: s}\n")
+	tests := []struct {
+		name    string
+		header  []string
+		body    string
+		ref     string
+		commit  string
+		author  string
+		message string
+		url     string
+	}{
+		{
+			name:    "push",
+			header:  []string{"X-Gitea-Event: push", "X-Gitea-Delivery: 9a3d4c5e-1b2f-4e6a-8c7d-0f1e2d3c4b5a"},
+			body:    giteaPushHook,
+			ref:     "refs/heads/main",
+			commit:  "bffeb74224043ba2feb48d137756c8a9331c449a",
+			author:  "Gitea",
+			message: "Webhooks Yay!",
+			url:     "https://gitea.example.com/gitea/webhooks/commit/bffeb74224043ba2feb48d137756c8a9331c449a",
+		},
+		{
+			name:    "forgejo push",
+			header:  []string{"X-Forgejo-Event: push", "X-Forgejo-Delivery: 9a3d4c5e-1b2f-4e6a-8c7d-0f1e2d3c4b5a"},
+			body:    giteaPushHook,
+			ref:     "refs/heads/main",
+			commit:  "bffeb74224043ba2feb48d137756c8a9331c449a",
+			author:  "Gitea",
+			message: "Webhooks Yay!",
+			url:     "https://gitea.example.com/gitea/webhooks/commit/bffeb74224043ba2feb48d137756c8a9331c449a",
+		},
+		{
+			name:    "published release",
+			header:  []string{"X-Gitea-Event: release", "X-Gitea-Delivery: 9a3d4c5e-1b2f-4e6a-8c7d-0f1e2d3c4b5a"},
+			body:    giteaReleaseHook,
+			ref:     "refs/tags/v1.2.0",
+			commit:  "v1.2.0",
+			author:  "Gitea",
+			message: "Version 1.2",
+			url:     "https://gitea.example.com/gitea/webhooks/releases/tag/v1.2.0",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event, err := parseWebhook(t, cfg, "gitea", newWebhook(tt.body, tt.header...), tt.body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if event.Repository != "gitea/webhooks" || event.Ref != tt.ref || event.Commit != tt.commit || event.Author != tt.author {
+				t.Errorf("event = %s %s %s by %s, want gitea/webhooks %s %s by %s",
+					event.Repository, event.Ref, event.Commit, event.Author, tt.ref, tt.commit, tt.author)
+			}
+			if event.DeliveryID != "9a3d4c5e-1b2f-4e6a-8c7d-0f1e2d3c4b5a" {
+				t.Errorf("delivery = %q", event.DeliveryID)
+			}
+			p := event.Payload
+			if p.Repository.Name != "webhooks" || p.Repository.HTMLURL != "https://gitea.example.com/gitea/webhooks" || p.Ref != tt.ref {
+				t.Errorf("payload = %s %s %s", p.Repository.Name, p.Repository.HTMLURL, p.Ref)
+			}
+			if p.HeadCommit.ID != tt.commit || p.HeadCommit.Message != tt.message || p.HeadCommit.URL != tt.url {
+				t.Errorf("head commit = %s %q %s, want %s %q %s",
+					p.HeadCommit.ID, p.HeadCommit.Message, p.HeadCommit.URL, tt.commit, tt.message, tt.url)
+			}
+		})
+	}
+}
+
+// A push without head_commit, as Gitea sends for a new branch, links the
+// after commit under the repository
+func TestGiteaPushWithoutHeadCommit(t *testing.T) {
+	cfg := loadTestConfig(t, "server: {secret: s}\n")
+	body := `{"ref":"refs/heads/release","after":"bffeb74224043ba2feb48d137756c8a9331c449a","head_commit":null,
+"repository":{"name":"webhooks","full_name":"gitea/webhooks","html_url":"https://gitea.example.com/gitea/webhooks"},
+"pusher":{"login":"gitea"}}`
+	event, err := parseWebhook(t, cfg, "gitea", newWebhook(body, "X-Gitea-Event: push"), body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Commit != "bffeb74224043ba2feb48d137756c8a9331c449a" || event.Author != "gitea" {
+		t.Errorf("event = %s by %s", event.Commit, event.Author)
+	}
+	if url := event.Payload.HeadCommit.URL; url != "https://gitea.example.com/gitea/webhooks/commit/bffeb74224043ba2feb48d137756c8a9331c449a" {
+		t.Errorf("commit URL = %s", url)
+	}
+}
+
+func TestGiteaIgnored(t *testing.T) {
+	cfg := loadTestConfig(t, "server: {secret: s}\n")
+	repo := `"repository":{"name":"webhooks","full_name":"gitea/webhooks"}`
+	tests := []struct {
+		name  string
+		event string
+		body  string
+	}{
+		{"deleted branch", "push", `{"ref":"refs/heads/feature-x","after":"` + nullSHA + `",` + repo + `}`},
+		{"draft release", "release", `{"action":"published","release":{"tag_name":"v1.3.0","draft":true},` + repo + `}`},
+		{"updated release", "release", `{"action":"updated","release":{"tag_name":"v1.2.0"},` + repo + `}`},
+		{"deleted release", "release", `{"action":"deleted","release":{"tag_name":"v1.2.0"},` + repo + `}`},
+		{"issues", "issues", `{"action":"opened",` + repo + `}`},
+	}
+	for _, tt := range tests {
+		_, err := parseWebhook(t, cfg, "gitea", newWebhook(tt.body, "X-Gitea-Event: "+tt.event), tt.body)
+		t.Run(tt.name, func(t *testing.T) { wantIgnored(t, err) })
+	}
+
+	body := `{"ref":"refs/heads/main","after":"bffeb742"}`
+	if _, err := parseWebhook(t, cfg, "gitea", newWebhook(body, "X-Gitea-Event: push"), body); err == nil {
+		t.Error("push without a repository was accepted")
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var errInvalidSignature = errors.New("invalid signature")
+
+// githubProvider handles GitHub push (branches and tags), release, published
+// package and workflow_run events, and answers ping with diagnostics
+type githubProvider struct{}
+
+// Events of GitHub webhooks that can deploy
+var githubDeployEvents = []string{"push", "release", "package", "workflow_run"}
+
+func (githubProvider) name() string { return "github" }
+
+func (githubProvider) match(r *http.Request, body []byte) bool {
+	return r.Header.Get("X-GitHub-Event") != ""
+}
+
+func (githubProvider) authenticate(r *http.Request, body []byte, config *Config) error {
+	if !verifySignature(r, body, config.Secret) {
+		return errInvalidSignature
+	}
+	return nil
+}
+
+func (p githubProvider) parse(r *http.Request, body []byte) (deployEvent, error) {
+	// Webhooks with content type form send the JSON in the payload field
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/x-www-form-urlencoded" {
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return deployEvent{}, fmt.Errorf("invalid form payload: %w", err)
+		}
+		body = []byte(form.Get("payload"))
+	}
+	var payload WebhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return deployEvent{}, fmt.Errorf("invalid JSON payload: %w", err)
+	}
+	event := deployEvent{
+		Provider:   p.name(),
+		Repository: payload.Repository.FullName,
+		DeliveryID: r.Header.Get("X-GitHub-Delivery"),
+		Payload:    payload,
+	}
+
+	eventType := r.Header.Get("X-GitHub-Event")
+	switch {
+	case eventType == "ping":
+		var ping githubPing
+		if err := json.Unmarshal(body, &ping); err != nil {
+			return event, fmt.Errorf("invalid ping payload: %w", err)
+		}
+		ping.Repository = payload.Repository.FullName
+		return event, ping
+	case eventType == "package" && payload.Action == "published":
+		event.Type = "package"
+		event.Commit = payload.Package.Version
+		event.Author = payload.Sender.Login
+	case eventType == "release":
+		release := payload.Release
+		if payload.Action != "published" || release.Draft {
+			return event, ignoreEvent(fmt.Sprintf("Release %s %s, only published releases deploy", release.TagName, payload.Action))
+		}
+		event.Type = "release"
+		event.Ref = "refs/tags/" + release.TagName
+		event.Commit = release.TagName
+		event.Author = firstNonEmpty(release.Author.Login, payload.Sender.Login)
+		event.Payload.Ref = event.Ref
+	case eventType == "workflow_run":
+		run := payload.WorkflowRun
+		if payload.Action != "completed" || run.Conclusion != "success" {
+			return event, ignoreEvent(fmt.Sprintf("Workflow run %s %s (%s), only successful runs deploy",
+				run.Name, payload.Action, firstNonEmpty(run.Conclusion, "no conclusion")))
+		}
+		event.Type = "workflow_run"
+		event.Workflow = run.Name
+		event.Ref = "refs/heads/" + run.HeadBranch
+		event.Commit = run.HeadSHA
+		event.Author = firstNonEmpty(run.Actor.Login, payload.Sender.Login)
+		event.Payload.Ref = event.Ref
+		event.Payload.HeadCommit.ID = run.HeadSHA
+		event.Payload.HeadCommit.Message = run.HeadCommit.Message
+		event.Payload.HeadCommit.URL = payload.Repository.HTMLURL + "/commit/" + run.HeadSHA
+		event.Payload.Pusher.Name = event.Author
+	// create and delete events carry a ref too; only a missing header falls back to it
+	case eventType == "push" || (eventType == "" && payload.Ref != ""):
+		if payload.Deleted {
+			return event, ignoreEvent(fmt.Sprintf("%s deleted", payload.Ref))
+		}
+		event.Type = "push"
+		event.Ref = payload.Ref
+		event.Commit = payload.HeadCommit.ID
+		event.Author = firstNonEmpty(payload.Pusher.Name, payload.Sender.Login)
+	case eventType != "":
+		return event, ignoreEvent(fmt.Sprintf("Unsupported GitHub event %q", eventType))
+	default:
+		return event, ignoreEvent("Unknown payload type")
+	}
+	return event, nil
+}
+
+// githubPing is the ping GitHub sends when a webhook is created. It is
+// answered with what the server makes of the hook's settings, which GitHub
+// shows under Recent Deliveries.
+type githubPing struct {
+	Zen    string `json:"zen"`
+	HookID int64  `json:"hook_id"`
+	Hook   struct {
+		Type   string   `json:"type"` // Repository, Organization or App
+		Active bool     `json:"active"`
+		Events []string `json:"events"`
+		Config struct {
+			ContentType string      `json:"content_type"`
+			InsecureSSL interface{} `json:"insecure_ssl"` // "0" or "1", sometimes a number
+			URL         string      `json:"url"`
+		} `json:"config"`
+	} `json:"hook"`
+	Repository string `json:"-"` // "" for organization hooks
+}
+
+func (p githubPing) Error() string {
+	return fmt.Sprintf("ping of hook %d", p.HookID)
+}
+
+func (p githubPing) reply(config *Config) map[string]interface{} {
+	warnings := []string{}
+	if !p.Hook.Active {
+		warnings = append(warnings, "the webhook is not active")
+	}
+	if fmt.Sprint(p.Hook.Config.InsecureSSL) == "1" {
+		warnings = append(warnings, "SSL verification is disabled (insecure_ssl)")
+	}
+
+	deploys := []string{}
+	for _, event := range githubDeployEvents {
+		if containsString(p.Hook.Events, event) || containsString(p.Hook.Events, "*") {
+			deploys = append(deploys, event)
+		}
+	}
+	if len(deploys) == 0 {
+		warnings = append(warnings, fmt.Sprintf("none of the subscribed events deploys (subscribe to %s)", strings.Join(githubDeployEvents, ", ")))
+	}
+	if p.Repository != "" {
+		rc, ok := config.repo(p.Repository)
+		if !ok {
+			warnings = append(warnings, fmt.Sprintf("%s is not in the pipeline file, the defaults apply", p.Repository))
+		}
+		if containsString(deploys, "workflow_run") && len(rc.Workflows) == 0 {
+			warnings = append(warnings, "workflow_run is subscribed, but no workflows are configured, so no run deploys")
+		}
+	}
+
+	return map[string]interface{}{
+		"status":       "pong",
+		"zen":          p.Zen,
+		"hook_id":      p.HookID,
+		"hook_type":    p.Hook.Type,
+		"repository":   p.Repository,
+		"content_type": p.Hook.Config.ContentType,
+		"events":       p.Hook.Events,
+		"deploys":      deploys,
+		"warnings":     warnings,
+	}
+}
+
+// workflowProvider handles the custom payload the GitHub Actions workflow
+// sends after pushing an image. It is signed like a GitHub webhook and
+// recognized by its content, whatever the headers say.
+type workflowProvider struct{}
+
+func (workflowProvider) name() string { return "workflow" }
+
+func (workflowProvider) match(r *http.Request, body []byte) bool {
+	var payload WebhookPayload
+	if json.Unmarshal(body, &payload) != nil {
+		return false
+	}
+	return payload.Docker.ImageName != "" && payload.Deployment.Environment != ""
+}
+
+func (workflowProvider) authenticate(r *http.Request, body []byte, config *Config) error {
+	return githubProvider{}.authenticate(r, body, config)
+}
+
+func (p workflowProvider) parse(r *http.Request, body []byte) (deployEvent, error) {
+	var payload WebhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return deployEvent{}, fmt.Errorf("invalid JSON payload: %w", err)
+	}
+	event := deployEvent{
+		Provider:    p.name(),
+		Type:        "workflow",
+		Repository:  payload.Repository.FullName,
+		Commit:      payload.Deployment.Commit,
+		Author:      firstNonEmpty(payload.Pusher.Name, payload.Sender.Login),
+		Image:       firstNonEmpty(payload.Docker.LatestImage, payload.Docker.ImageName),
+		Environment: payload.Deployment.Environment,
+		DeliveryID:  r.Header.Get("X-GitHub-Delivery"),
+		Payload:     payload,
+	}
+	if payload.Deployment.Branch != "" {
+		event.Ref = "refs/heads/" + payload.Deployment.Branch
+	}
+	return event, nil
+}
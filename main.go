@@ -1,28 +1,26 @@
 package main
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
 )
 
-type Config struct {
-	Port           string
-	Secret         string
-	DiscordWebhook string
-}
-
 type WebhookPayload struct {
 	Repository struct {
 		Name     string `json:"name"`
@@ -38,7 +36,40 @@ type WebhookPayload struct {
 		Message string `json:"message"`
 		URL     string `json:"url"`
 	} `json:"head_commit"`
-	Ref string `json:"ref"`
+	Ref     string `json:"ref"`
+	Deleted bool   `json:"deleted"` // push that deleted its branch or tag
+	Sender  struct {
+		Login string `json:"login"`
+	} `json:"sender"`
+
+	// GitHub release events
+	Release struct {
+		TagName    string `json:"tag_name"`
+		Name       string `json:"name"`
+		HTMLURL    string `json:"html_url"`
+		Draft      bool   `json:"draft"`
+		Prerelease bool   `json:"prerelease"`
+		Author     struct {
+			Login string `json:"login"`
+		} `json:"author"`
+	} `json:"release"`
+
+	// GitHub workflow_run events
+	WorkflowRun struct {
+		Name       string `json:"name"`
+		RunNumber  int    `json:"run_number"`
+		HeadBranch string `json:"head_branch"`
+		HeadSHA    string `json:"head_sha"`
+		Event      string `json:"event"` // what started the run, e.g. push
+		Conclusion string `json:"conclusion"`
+		HTMLURL    string `json:"html_url"`
+		HeadCommit struct {
+			Message string `json:"message"`
+		} `json:"head_commit"`
+		Actor struct {
+			Login string `json:"login"`
+		} `json:"actor"`
+	} `json:"workflow_run"`
 
 	// Support for GitHub Package Events (chuẩn)
 	Package struct {
@@ -71,6 +102,12 @@ type WebhookPayload struct {
 	} `json:"deployment"`
 }
 
+// deploysImage reports whether the payload names a Docker image to run, as
+// opposed to a source deployment running the repository's commands
+func (p WebhookPayload) deploysImage() bool {
+	return p.Docker.ImageName != "" || p.Docker.LatestImage != ""
+}
+
 type DiscordMessage struct {
 	Content string                `json:"content,omitempty"`
 	Embeds  []DiscordMessageEmbed `json:"embeds,omitempty"`
@@ -95,16 +132,6 @@ type DiscordMessageEmbedFooter struct {
 	Text string `json:"text"`
 }
 
-var config Config
-
-func init() {
-	config = Config{
-		Port:           getEnv("PORT", "8300"),
-		Secret:         getEnv("WEBHOOK_SECRET", "your_secret_here"),
-		DiscordWebhook: getEnv("DISCORD_WEBHOOK", "https://discord.com/api/webhooks/1393287834173050990/9Mb6VxMhpB_UOqf9HEXkbV85N0sLRIpeGDZqFHuQGiZwjzx_FQzt_Xh-Vg6ozo0PJcCa"),
-	}
-}
-
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return strings.TrimSpace(value) // Trim whitespace để tránh lỗi
@@ -113,11 +140,59 @@ func getEnv(key, defaultValue string) string {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "serve":
+		case "validate":
+			os.Exit(runValidate(os.Args[2:]))
+		case "plan":
+			os.Exit(runPlan(os.Args[2:]))
+		case "-h", "-help", "--help", "help":
+			fmt.Print(usage)
+			return
+		default:
+			fmt.Fprintf(os.Stderr, "Unknown command %q\n\n%s", os.Args[1], usage)
+			os.Exit(2)
+		}
+	}
+
+	serve()
+}
+
+func serve() {
+	config, err := loadConfig()
+	if err == nil {
+		err = config.validate()
+	}
+	if err != nil {
+		log.Fatalf("Error loading configuration: %v", err)
+	}
+	setConfig(config)
+	go watchConfig()
+
+	store, err := openStore(config.DataDir)
+	if err != nil {
+		log.Fatalf("Error opening data directory: %v", err)
+	}
+	traffic = newTrafficRouter(store)
+	if jobQueue, err = newDeployQueue(store, runDeploymentJob, notifySkippedJob); err != nil {
+		log.Fatalf("Error restoring deployment queue: %v", err)
+	}
+
 	// In ra cấu hình khi start
 	log.Printf("=== WEBHOOK CONFIGURATION ===")
 	log.Printf("Port: %s", config.Port)
-	log.Printf("Secret: %s", config.Secret)
+	log.Printf("Secret set: %t", config.Secret != "")
 	log.Printf("Discord Webhook: %s", config.DiscordWebhook)
+	log.Printf("Data Dir: %s", config.DataDir)
+	log.Printf("Docker: %s executor, host %s", config.Docker.Executor, config.Docker.Host)
+	log.Printf("Queue: %d workers, %d queued max (%d per repository), debounce %v",
+		config.Queue.MaxWorkers, config.Queue.MaxQueued, config.Queue.MaxPerRepo, config.Queue.Debounce)
+	if config.File != "" {
+		log.Printf("Pipeline file: %s (%d repositories)", config.File, len(config.Repos))
+	} else {
+		log.Printf("Pipeline file: none, using DEPLOY_COMMANDS_*/WORK_DIR_* env vars")
+	}
 	log.Printf("=============================")
 
 	r := mux.NewRouter()
@@ -130,8 +205,23 @@ func main() {
 	r.HandleFunc("/deploy", deployHandler).Methods("POST")
 	r.HandleFunc("/health", healthHandler).Methods("GET")
 
+	api := r.NewRoute().Subrouter()
+	api.Use(apiAuthMiddleware)
+	api.HandleFunc("/deployments", listDeploymentsHandler).Methods("GET")
+	api.HandleFunc("/deployments/{id}", getDeploymentHandler).Methods("GET")
+	api.HandleFunc("/deployments/{id}", cancelDeploymentHandler).Methods("DELETE")
+	api.HandleFunc("/deployments/{id}/logs", deploymentLogsHandler).Methods("GET")
+	api.HandleFunc("/deployments/{id}/redeploy", redeployHandler).Methods("POST")
+	// Repository names may be nested, e.g. GitLab's group/subgroup/project
+	api.HandleFunc("/repos/{repo:.+}/environments/{env}/rollback", rollbackHandler).Methods("POST")
+
+	srv := &http.Server{
+		Addr:    ":" + config.Port,
+		Handler: r,
+	}
+
 	log.Printf("Starting webhook server on port %s", config.Port)
-	log.Fatal(http.ListenAndServe(":"+config.Port, r))
+	serveUntilSignal(srv)
 }
 
 func loggingMiddleware(next http.Handler) http.Handler {
@@ -160,6 +250,9 @@ func rateLimitMiddleware(next http.Handler) http.Handler {
 }
 
 func deployHandler(w http.ResponseWriter, r *http.Request) {
+	// Every request works on one config snapshot, even if a reload happens meanwhile
+	config := getConfig()
+
 	// Security checks
 	if !isValidRequest(r) {
 		log.Printf("Unauthorized request from %s", r.RemoteAddr)
@@ -175,66 +268,196 @@ func deployHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Verify signature
-	if !verifySignature(r, body) {
-		log.Printf("Invalid signature from %s", r.RemoteAddr)
-		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+	// Every source has its own signature scheme and payload layout; the
+	// provider turns the request into a canonical deploy event
+	source := findProvider(r, body)
+	if err := source.authenticate(r, body, config); err != nil {
+		log.Printf("Rejecting %s webhook from %s: %v", source.name(), r.RemoteAddr, err)
+		http.Error(w, "Invalid signature or token", http.StatusUnauthorized)
 		return
 	}
-
-	// Parse webhook payload
-	var payload WebhookPayload
-	if err := json.Unmarshal(body, &payload); err != nil {
-		log.Printf("Error parsing JSON payload: %v", err)
-		http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+	event, err := source.parse(r, body)
+	if err == nil {
+		err = routeImage(config, &event)
+		routeRef(config, &event)
+	}
+	var reply replyEvent
+	var ignore ignoreEvent
+	if errors.As(err, &reply) {
+		log.Printf("Answering %s webhook: %s", source.name(), reply)
+		writeJSON(w, http.StatusOK, reply.reply(config))
+		return
+	} else if errors.As(err, &ignore) {
+		log.Printf("Ignoring %s webhook: %s", source.name(), ignore)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{
+			"status":  "ignored",
+			"message": string(ignore),
+		})
+		return
+	} else if err != nil {
+		log.Printf("Error parsing %s webhook: %v", source.name(), err)
+		http.Error(w, "Invalid payload: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	// Get event type from header
-	eventType := r.Header.Get("X-GitHub-Event")
-
-	// Detect payload type and handle accordingly
-	var payloadType string
-	if payload.Docker.ImageName != "" && payload.Deployment.Environment != "" {
-		// Custom Workflow Payload (từ GitHub Actions)
-		payloadType = "workflow"
-		log.Printf("Received workflow webhook for repository: %s, environment: %s, image: %s",
-			payload.Repository.FullName, payload.Deployment.Environment, payload.Docker.LatestImage)
-	} else if eventType == "package" && payload.Action == "published" {
-		// GitHub Package Events (chuẩn)
-		payloadType = "package"
-		log.Printf("Received package webhook for repository: %s, package: %s@%s",
-			payload.Repository.FullName, payload.Package.Name, payload.Package.Version)
-	} else if eventType == "push" || payload.Ref != "" {
-		// GitHub Push Events (chuẩn)
-		payloadType = "push"
-		log.Printf("Received push webhook for repository: %s, ref: %s", payload.Repository.FullName, payload.Ref)
-	} else {
-		log.Printf("Unknown payload type for repository: %s", payload.Repository.FullName)
+	log.Printf("Received %s webhook (%s) for repository: %s, ref: %s, commit: %s, environment: %s",
+		event.Provider, event.Type, event.Repository, event.Ref, shortSHA(event.Commit), event.environment())
+
+	// Apply branch, tag and workflow filters from the pipeline file
+	repoConfig, _ := config.repo(event.Repository)
+	if reason := repoConfig.skipReason(event); reason != "" {
+		log.Printf("Ignoring %s webhook for %s: %s", event.Provider, event.Repository, reason)
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(map[string]string{
 			"status":  "ignored",
-			"message": "Unknown payload type",
+			"message": reason,
 		})
 		return
 	}
 
-	// Execute deployment (asynchronously)
-	go func() {
-		deploySuccess := executeDeployment(payload)
-		sendDiscordNotification(payload, deploySuccess, payloadType)
-	}()
+	// Only deploy images from allowed registries, never a pull command that
+	// differs from the image the payload names, and only to known environments
+	if event.Image != "" {
+		if _, err := workflowImage(config, event.Payload); err != nil {
+			log.Printf("Rejecting %s webhook for %s: %v", event.Provider, event.Repository, err)
+			http.Error(w, "Invalid Docker payload: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if event.Environment != "" {
+		if err := config.checkEnvironment(event.Environment); err != nil {
+			log.Printf("Rejecting %s webhook for %s: %v", event.Provider, event.Repository, err)
+			http.Error(w, "Invalid deployment: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Queue the deployment; jobs of the same repository/environment run one at a time
+	job := &deployJob{
+		ID:          deploymentID(event.DeliveryID),
+		Repository:  event.Repository,
+		Environment: event.environment(),
+		Provider:    event.Provider,
+		PayloadType: event.Type,
+		Payload:     event.Payload,
+		Commit:      event.Commit,
+	}
+	if err := jobQueue.enqueue(job); err != nil {
+		status := queueErrorStatus(err)
+		log.Printf("Rejecting webhook for %s: %v", event.Repository, err)
+		if status != http.StatusInternalServerError {
+			w.Header().Set("Retry-After", strconv.Itoa(int(config.Queue.RetryAfter.Seconds())))
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	log.Printf("Queued deployment %s for %s (%s)", job.ID, job.Repository, job.Environment)
 
 	// Return immediate response
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/deployments/"+job.ID)
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{
-		"status":  "accepted",
-		"message": "Deployment initiated",
-		"type":    payloadType,
+		"status":        "accepted",
+		"message":       "Deployment initiated",
+		"type":          event.Type,
+		"provider":      event.Provider,
+		"deployment_id": job.ID,
 	})
 }
 
+// deploymentID reuses the delivery id of the webhook so a deployment can be
+// traced back to it. Redeliveries keep the same id; enqueue gives those a
+// suffix.
+func deploymentID(delivery string) string {
+	if delivery == "" || strings.ContainsAny(delivery, "/?#") {
+		return newJobID()
+	}
+	return delivery
+}
+
+// runDeploymentJob executes a queued job with the config active at the
+// moment it starts and reports the result to Discord.
+func runDeploymentJob(job deployJob, setPhase func(string)) string {
+	config := getConfig()
+	run := &deployRun{
+		ctx: abandonCtx,
+		log: deployLogs.get(job.ID),
+		onStep: func(step stepResult) {
+			jobQueue.update(job.ID, func(j *deployJob) { j.Steps = append(j.Steps, step) })
+		},
+		onImage: func(image, digest string) {
+			jobQueue.update(job.ID, func(j *deployJob) {
+				j.Image = image
+				j.ImageDigest = firstNonEmpty(digest, j.ImageDigest)
+			})
+		},
+		onReadiness: func(result readinessResult) {
+			jobQueue.update(job.ID, func(j *deployJob) { j.Readiness = &result })
+		},
+		onCrash: func(report crashReport) {
+			jobQueue.update(job.ID, func(j *deployJob) { j.Crash = &report })
+		},
+	}
+
+	var timeout *timeoutError
+	err := executeDeployment(config, job.Payload, run)
+	if abandonCtx.Err() != nil {
+		// Killed at the end of the shutdown grace period: the job stays
+		// persisted as running and starts over on the next start
+		return jobRunning
+	}
+	switch {
+	case err == nil:
+		job.State = jobSucceeded
+	case errors.As(err, &timeout):
+		job.State = jobTimedOut
+	default:
+		job.State = jobFailed
+	}
+	if err != nil {
+		job.Reason = err.Error()
+	}
+
+	if err == nil {
+		if record, ok := jobQueue.lookup(job.ID); ok {
+			recordRelease(jobQueue.store, record)
+		}
+	} else {
+		setPhase("rolling back")
+		job.Rollback = rollBack(config, job, run)
+	}
+
+	setPhase("sending Discord notification")
+	jobQueue.update(job.ID, func(j *deployJob) { j.Reason, j.Rollback = job.Reason, job.Rollback })
+	if record, ok := jobQueue.lookup(job.ID); ok {
+		record.State = job.State
+		sendDiscordNotification(config, &record)
+	}
+	return job.State
+}
+
+// notifySkippedJob reports a superseded job to Discord
+func notifySkippedJob(job *deployJob) {
+	taskID, ok := inflight.start(job.Repository, "sending Discord notification")
+	if !ok {
+		return
+	}
+	defer inflight.done(taskID)
+	sendDiscordNotification(getConfig(), job)
+}
+
+// shortSHA abbreviates a commit hash the way GitHub displays it. Anything
+// else, such as a tag or package version, is returned as is.
+func shortSHA(sha string) string {
+	if len(sha) > 7 && strings.Trim(strings.ToLower(sha), "0123456789abcdef") == "" {
+		return sha[:7]
+	}
+	return sha
+}
+
 func isValidRequest(r *http.Request) bool {
 	return true
 }
@@ -255,7 +478,7 @@ func getClientIP(r *http.Request) string {
 	return strings.Split(r.RemoteAddr, ":")[0]
 }
 
-func verifySignature(r *http.Request, body []byte) bool {
+func verifySignature(r *http.Request, body []byte, secret string) bool {
 	signature := r.Header.Get("X-Hub-Signature-256")
 	if signature == "" {
 		// Also check GitHub's alternative header
@@ -267,182 +490,428 @@ func verifySignature(r *http.Request, body []byte) bool {
 		return false
 	}
 
-	log.Printf("=== SIGNATURE VERIFICATION ===")
-	log.Printf("Received signature: %s", signature)
-	log.Printf("Using secret: %s", config.Secret)
-	log.Printf("Payload length: %d bytes", len(body))
-	result := checkSignature(body, signature, config.Secret)
-	log.Printf("Verification result: %t", result)
-	log.Printf("===============================")
-
+	result := checkSignature(body, signature, secret)
+	log.Printf("Signature verification passed: %t", result)
 	return result
 }
 
 func checkSignature(payload []byte, signature, secret string) bool {
 	// Remove "sha256=" prefix if present
-	originalSignature := signature
-	if strings.HasPrefix(signature, "sha256=") {
-		signature = signature[7:]
-	}
+	signature = strings.TrimPrefix(signature, "sha256=")
 
 	mac := hmac.New(sha256.New, []byte(secret))
 	mac.Write(payload)
 	expectedMAC := hex.EncodeToString(mac.Sum(nil))
 
-	log.Printf("Original signature: %s", originalSignature)
-	log.Printf("Cleaned signature: %s", signature)
-	log.Printf("Expected signature: sha256=%s", expectedMAC)
-	log.Printf("Signatures match: %t", hmac.Equal([]byte(signature), []byte(expectedMAC)))
-
 	return hmac.Equal([]byte(signature), []byte(expectedMAC))
 }
 
-func executeDeployment(payload WebhookPayload) bool {
-	log.Printf("Starting deployment for %s", payload.Repository.FullName)
-
-	// Get deployment commands based on project type and payload
-	commands := getDeploymentCommands(payload.Repository.FullName)
-
-	// If it's a workflow payload with Docker info, use Docker pull command
-	if payload.Docker.ImageName != "" && payload.Docker.PullCommand != "" && payload.Docker.LatestImage != "" {
-		log.Printf("Detected workflow payload with Docker info")
-		log.Printf("Docker Image: %s", payload.Docker.LatestImage)
-		log.Printf("Environment: %s", payload.Deployment.Environment)
+// deploymentPlan is everything executeDeployment needs to know before it
+// runs the first command. The plan subcommand prints it without executing.
+type deploymentPlan struct {
+	Repository string
+	WorkDir    string
+	Steps      []Step        // with Timeout and Shell resolved for every step
+	Timeout    time.Duration // deadline of the whole pipeline
+	Docker     bool          // steps were built from the workflow payload's Docker info
+	Image      string        // normalized image reference of a Docker plan
+	Notes      []string      // warnings found while resolving the plan
+	Err        error         // why the payload cannot be deployed at all
+}
 
-		// Use custom Docker commands for workflow payloads
-		// Extract container name from repository (remove owner prefix)
-		repoName := payload.Repository.Name // mrs_address_be
-		containerName := repoName
-		log.Printf("Container Name: %s", containerName)
+func planDeployment(config *Config, payload WebhookPayload) deploymentPlan {
+	repoConfig, _ := config.repo(payload.Repository.FullName)
+	plan := deploymentPlan{
+		Repository: payload.Repository.FullName,
+		Timeout:    repoConfig.Timeout,
+	}
 
-		dockerCommands := []string{
-			payload.Docker.PullCommand,
-			fmt.Sprintf("docker stop %s", containerName),
-			fmt.Sprintf("docker rm %s", containerName),
+	// Get deployment commands based on project type and payload
+	steps := getDeploymentSteps(config, payload.Repository.FullName)
+	readiness := repoConfig.Readiness
+
+	// If it's a workflow payload with Docker info, pull and run the image it names.
+	// The commands are built here from the validated reference; the payload's
+	// pull_command is only compared against it, never executed.
+	if payload.deploysImage() {
+		plan.Docker = true
+		image, err := workflowImage(config, payload)
+		if err != nil {
+			plan.Err = fmt.Errorf("invalid Docker payload: %w", err)
+			return plan
+		}
+		envName := payload.Deployment.Environment
+		env, ok := config.environment(repoConfig, envName)
+		if !ok {
+			plan.Err = config.checkEnvironment(envName)
+			return plan
 		}
 
-		// Add run command based on environment
-		var runCommand string
-		if payload.Deployment.Environment == "production" {
-			runCommand = fmt.Sprintf("docker run -d --name %s -p 8100:8100 %s",
-				containerName, payload.Docker.LatestImage)
+		// The container spec of the repository/environment decides how the image runs;
+		// the container is named after the repository (remove owner prefix) plus the
+		// environment suffix
+		spec := repoConfig.containerSpec(payload.Repository.Name, envName, env)
+		runCommand, runEnv := spec.runCommand(image.String())
+		readiness = readiness.merge(env.Readiness)
+		container := func() string { return spec.Name }
+
+		if env.Strategy == strategyBlueGreen {
+			service, err := newBlueGreenService(spec, env.BlueGreen)
+			if err == nil && config.Docker.Executor != "api" {
+				err = errors.New("strategy blue_green needs server.docker.executor: api")
+			}
+			if err != nil {
+				plan.Err = fmt.Errorf("environment %s: %w", envName, err)
+				return plan
+			}
+			steps = blueGreenSteps(config.Docker.Host, image, service)
+			container = service.liveName
+		} else if config.Docker.Executor == "api" {
+			steps = dockerAPISteps(config.Docker.Host, image, spec, runCommand)
 		} else {
-			runCommand = fmt.Sprintf("docker run -d --name %s-staging -p 8101:8100 %s",
-				containerName, payload.Docker.LatestImage)
+			steps = commandSteps([]string{
+				fmt.Sprintf("docker pull %s", image),
+				fmt.Sprintf("docker stop %s", spec.Name),
+				fmt.Sprintf("docker rm %s", spec.Name),
+				runCommand,
+			})
+			steps[1].cutover = true
+			steps[len(steps)-1].Env = runEnv
 		}
-		dockerCommands = append(dockerCommands, runCommand)
 
-		// Use Docker commands if available, otherwise fall back to configured commands
-		if len(dockerCommands) > 0 {
-			commands = dockerCommands
-			log.Printf("Using Docker commands from workflow payload")
+		// Crash loops show up only after docker run has returned
+		if watch := repoConfig.Watch.merge(env.Watch); watch.Window > 0 {
+			steps = append(steps, watchStep(config.Docker.Host, watch, spec.Name, container))
 		}
-	} else if payload.Docker.ImageName != "" || payload.Docker.PullCommand != "" {
-		log.Printf("Incomplete Docker payload info - ImageName: '%s', PullCommand: '%s', LatestImage: '%s'",
-			payload.Docker.ImageName, payload.Docker.PullCommand, payload.Docker.LatestImage)
-	}
 
-	if len(commands) == 0 {
-		log.Printf("No deployment commands configured for %s", payload.Repository.FullName)
-		return false
-	}
-
-	// For Docker workflows, we don't need working directories - Docker handles everything
-	var workingDir string
+		// For Docker workflows, we don't need working directories - Docker handles everything
+		plan.Image = image.String()
 
-	// Check if we're using Docker workflow (from GitHub Actions)
-	if payload.Docker.ImageName != "" && payload.Docker.PullCommand != "" && payload.Docker.LatestImage != "" {
-		log.Printf("Using Docker workflow - no working directory needed")
+		// The commands contain payload values, never hand them to a shell
+		argv := false
+		for i := range steps {
+			steps[i].Shell = &argv
+		}
 	} else {
+		if payload.Docker.PullCommand != "" {
+			plan.Notes = append(plan.Notes, fmt.Sprintf("Incomplete Docker payload info - ImageName: '%s', PullCommand: '%s', LatestImage: '%s'",
+				payload.Docker.ImageName, payload.Docker.PullCommand, payload.Docker.LatestImage))
+		}
+
 		// Only use working directory for non-Docker deployments
-		workingDir = getWorkingDirectory(payload.Repository.FullName)
+		plan.WorkDir = getWorkingDirectory(config, payload.Repository.FullName)
 
 		// Verify working directory exists before using it
-		if workingDir != "" {
-			if _, err := os.Stat(workingDir); os.IsNotExist(err) {
-				log.Printf("Warning: Working directory %s does not exist, continuing without changing directory", workingDir)
-				workingDir = "" // Reset to empty so we don't use it
-			} else {
-				log.Printf("Using working directory: %s", workingDir)
+		if plan.WorkDir != "" {
+			if _, err := os.Stat(plan.WorkDir); os.IsNotExist(err) {
+				plan.Notes = append(plan.Notes, fmt.Sprintf("Working directory %s does not exist, continuing without changing directory", plan.WorkDir))
+				plan.WorkDir = "" // Reset to empty so we don't use it
 			}
 		}
 	}
 
-	for _, cmd := range commands {
-		// Trim whitespace and skip empty commands
-		cmd = strings.TrimSpace(cmd)
-		if cmd == "" {
+	// Trim whitespace, skip empty commands and apply the repository defaults
+	for _, step := range steps {
+		if step.Run = strings.TrimSpace(step.Run); step.Run == "" {
 			continue
 		}
+		if step.Timeout == 0 {
+			step.Timeout = repoConfig.StepTimeout
+		}
+		shell := step.useShell(repoConfig.Shell)
+		step.Shell = &shell
+		if !shell && step.call == nil {
+			if _, _, err := splitCommandLine(step.Run); err != nil {
+				plan.Notes = append(plan.Notes, fmt.Sprintf("Step %d (%s) will fail: %v", len(plan.Steps)+1, step.Run, err))
+			}
+		}
+		plan.Steps = append(plan.Steps, step)
+	}
 
-		log.Printf("Executing: %s", cmd)
+	// The deployment only counts once the service answers
+	if readiness.URL != "" && len(plan.Steps) > 0 {
+		plan.Steps = append(plan.Steps, readinessStep(readiness))
+	}
 
-		parts := strings.Fields(cmd) // Use Fields instead of Split for better whitespace handling
-		if len(parts) == 0 {
-			log.Printf("Skipping empty command")
-			continue
+	return plan
+}
+
+// stepResult is the outcome of one command of a deployment
+type stepResult struct {
+	Command    string    `json:"command"`
+	Mode       string    `json:"mode"`   // "argv" or "shell"
+	Status     string    `json:"status"` // "succeeded", "failed", "timed_out" or "ignored" (expected failure)
+	ExitCode   int       `json:"exit_code"`
+	StartedAt  time.Time `json:"started_at"`
+	DurationMs int64     `json:"duration_ms"`
+	Output     string    `json:"output"`
+	Rollback   bool      `json:"rollback,omitempty"` // part of the automatic rollback
+}
+
+// Output kept per step in the deployment record; the log gets all of it
+const maxStepOutput = 64 * 1024
+
+// How long a killed command may keep its output pipes open (e.g. through a
+// daemonized grandchild) before Wait gives up on them
+const killWaitDelay = 5 * time.Second
+
+// timeoutError is returned by executeDeployment when a step or the whole
+// pipeline ran out of time, as opposed to a command failing on its own
+type timeoutError struct {
+	What  string
+	After time.Duration
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("%s timed out after %v", e.What, e.After)
+}
+
+// deployRun carries the per-deployment context and outputs of executeDeployment
+type deployRun struct {
+	ctx         context.Context
+	log         *deployLog                 // live output, streamed by the logs endpoint
+	onStep      func(stepResult)           // called after each command to update the record
+	onImage     func(image, digest string) // called with the image of a Docker deployment
+	onReadiness func(readinessResult)      // called with the result of the readiness check
+	onCrash     func(crashReport)          // called when a watched container did not stay up
+
+	steps     int  // steps run so far; a rollback continues the numbering
+	disrupted bool // a cutover step ran, the previous version is no longer serving
+	rollback  bool // running the automatic rollback of a failed deployment
+}
+
+// stepFunc is a step that runs in-process instead of as a command, such as a
+// Docker Engine API call. Output written to out ends up in the step log.
+type stepFunc func(ctx context.Context, out io.Writer, run *deployRun) error
+
+// errNothingToDo is returned by steps that failed in an expected, harmless
+// way, e.g. stopping a container that does not exist
+var errNothingToDo = errors.New("nothing to do")
+
+// executeDeployment runs the plan of a payload. It returns a *timeoutError
+// when a deadline was hit and a plain error for any other failure.
+func executeDeployment(config *Config, payload WebhookPayload, run *deployRun) error {
+	log.Printf("Starting deployment for %s", payload.Repository.FullName)
+
+	repoConfig, _ := config.repo(payload.Repository.FullName)
+	plan := planDeployment(config, payload)
+	for _, note := range plan.Notes {
+		log.Printf("Warning: %s", note)
+	}
+
+	if plan.Docker {
+		log.Printf("Detected workflow payload with Docker info")
+		log.Printf("Docker Image: %s", plan.Image)
+		log.Printf("Environment: %s", payload.Deployment.Environment)
+		log.Printf("Using Docker workflow - no working directory needed")
+		if run.onImage != nil && plan.Image != "" {
+			run.onImage(plan.Image, "")
 		}
+	} else if plan.WorkDir != "" {
+		log.Printf("Using working directory: %s", plan.WorkDir)
+	}
+
+	if plan.Err != nil {
+		log.Printf("Cannot deploy %s: %v", payload.Repository.FullName, plan.Err)
+		return plan.Err
+	}
+	if len(plan.Steps) == 0 {
+		log.Printf("No deployment commands configured for %s", payload.Repository.FullName)
+		return errors.New("no deployment commands configured")
+	}
 
-		execCmd := exec.Command(parts[0], parts[1:]...)
+	ctx := run.ctx
+	if plan.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, plan.Timeout)
+		defer cancel()
+	}
 
-		// Set working directory if specified and exists (only for non-Docker workflows)
-		if workingDir != "" {
-			execCmd.Dir = workingDir
-			log.Printf("Running in directory: %s", workingDir)
+	for _, planned := range plan.Steps {
+		run.steps++
+		step, cmd, mode := run.steps, planned.Run, planned.mode()
+		log.Printf("Executing (%s): %s", mode, cmd)
+		if planned.cutover {
+			run.disrupted = true
 		}
 
-		output, err := execCmd.CombinedOutput()
+		stepCtx, cancel := ctx, context.CancelFunc(func() {})
+		if planned.Timeout > 0 {
+			stepCtx, cancel = context.WithTimeout(ctx, planned.Timeout)
+		}
 
-		if err != nil {
+		// Stream stdout and stderr line by line while keeping the combined output
+		var mu sync.Mutex
+		var combined strings.Builder
+		stdout := &lineWriter{log: run.log, step: step, stream: "stdout", mu: &mu, buf: &combined}
+		stderr := &lineWriter{log: run.log, step: step, stream: "stderr", mu: &mu, buf: &combined}
+
+		run.log.stepMarker(step, cmd, mode, "started")
+		started := time.Now()
+		var exitCode int
+		var err error
+		if planned.call != nil {
+			// Docker Engine API steps run in-process
+			if err = planned.call(stepCtx, stdout, run); err != nil && !errors.Is(err, errNothingToDo) {
+				exitCode = -1
+				fmt.Fprintln(stderr, err)
+			}
+		} else {
+			exitCode, err = runCommand(stepCtx, planned, repoConfig, plan.WorkDir, stdout, stderr)
+		}
+		stdout.flush()
+		stderr.flush()
+		output := combined.String()
+
+		// A deadline wins over the exit status: a killed command just reports "signal: killed"
+		var timeout *timeoutError
+		switch {
+		case ctx.Err() == context.DeadlineExceeded:
+			timeout = &timeoutError{What: "pipeline", After: plan.Timeout}
+		case stepCtx.Err() == context.DeadlineExceeded:
+			timeout = &timeoutError{What: fmt.Sprintf("step %d (%s)", step, cmd), After: planned.Timeout}
+		}
+		cancel()
+
+		result := stepResult{
+			Command:    cmd,
+			Mode:       mode,
+			Status:     "succeeded",
+			ExitCode:   exitCode,
+			StartedAt:  started.UTC(),
+			DurationMs: time.Since(started).Milliseconds(),
+			Output:     truncateOutput(output, maxStepOutput),
+			Rollback:   run.rollback,
+		}
+
+		if timeout != nil {
+			log.Printf("Command timed out: %s, %v, process group killed", cmd, timeout)
+			result.Status = "timed_out"
+			err = timeout
+		} else if errors.Is(err, errNothingToDo) {
+			log.Printf("Command failed (expected): %s - %s, continuing...", cmd, strings.TrimSpace(output))
+			result.Status = "ignored"
+			err = nil
+		} else if err != nil {
 			// Some Docker commands are expected to fail (like stopping non-existent containers)
 			isDockerStopOrRm := strings.Contains(cmd, "docker stop") || strings.Contains(cmd, "docker rm")
-			isContainerNotFound := strings.Contains(string(output), "No such container")
+			isContainerNotFound := strings.Contains(output, "No such container")
 
 			if isDockerStopOrRm && isContainerNotFound {
 				log.Printf("Command failed (expected): %s - Container doesn't exist, continuing...", cmd)
+				result.Status = "ignored"
+				err = nil
 			} else {
-				log.Printf("Command failed: %s, Error: %v, Output: %s", cmd, err, string(output))
-				return false
+				log.Printf("Command failed: %s, Error: %v, Output: %s", cmd, err, output)
+				result.Status = "failed"
+				if result.Output == "" {
+					result.Output = err.Error()
+				}
+				err = fmt.Errorf("step %d (%s) failed: %w", step, cmd, err)
 			}
 		}
+		run.log.stepMarker(step, cmd, mode, result.Status)
+		run.onStep(result)
+		if err != nil {
+			return err
+		}
 
 		log.Printf("Command successful: %s", cmd)
 		if len(output) > 0 {
-			log.Printf("Output: %s", string(output))
+			log.Printf("Output: %s", output)
 		} else {
 			log.Printf("Command completed with no output")
 		}
 	}
 
 	log.Printf("Deployment completed successfully for %s", payload.Repository.FullName)
-	return true
+	return nil
 }
 
-func getDeploymentCommands(repoName string) []string {
-	// 1. Check for custom commands in environment variables (per repository)
-	repoKey := strings.ReplaceAll(strings.ToUpper(repoName), "/", "_")
-	repoKey = strings.ReplaceAll(repoKey, "-", "_")
+// runCommand runs a command step as a child process and returns its exit code
+func runCommand(ctx context.Context, step Step, repoConfig RepoConfig, dir string, stdout, stderr io.Writer) (int, error) {
+	// Shell mode hands the whole line to /bin/sh; argv mode splits it
+	// with POSIX quoting and runs the program directly
+	name, args, env := shellPath, []string{"-c", step.Run}, []string(nil)
+	if step.mode() == "argv" {
+		var argv []string
+		var err error
+		if env, argv, err = splitCommandLine(step.Run); err != nil {
+			return -1, err
+		}
+		name, args = argv[0], argv[1:]
+	}
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Env = append(append(repoConfig.environ(), envList(step.Env)...), env...)
+	cmd.WaitDelay = killWaitDelay
+	killProcessGroupOnCancel(cmd)
+
+	// Set working directory if specified and exists (only for non-Docker workflows)
+	if dir != "" {
+		cmd.Dir = dir
+		log.Printf("Running in directory: %s", dir)
+	}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	err := cmd.Run()
+	return cmd.ProcessState.ExitCode(), err
+}
+
+// truncateOutput keeps the end of long command output, where errors usually are
+func truncateOutput(output string, limit int) string {
+	if len(output) <= limit {
+		return output
+	}
+	return "...(truncated)...\n" + output[len(output)-limit:]
+}
+
+func getDeploymentSteps(config *Config, repoName string) []Step {
+	// 1. Check for steps of this repository in the pipeline file
+	if repo, ok := config.Repos[strings.ToLower(repoName)]; ok && len(repo.Steps) > 0 {
+		return repo.Steps
+	}
+
+	// 2. Check for custom commands in environment variables (per repository)
+	repoKey := repoEnvKey(repoName)
 
 	// Check for repository-specific commands
 	if customCommands := os.Getenv("DEPLOY_COMMANDS_" + repoKey); customCommands != "" {
-		return strings.Split(customCommands, ";")
+		return commandSteps(strings.Split(customCommands, ";"))
 	}
 
-	// 2. Check for generic custom commands
+	// 3. Check for default steps in the pipeline file, then generic custom commands
+	if len(config.Defaults.Steps) > 0 {
+		return config.Defaults.Steps
+	}
 	if customCommands := os.Getenv("DEPLOY_COMMANDS"); customCommands != "" {
-		return strings.Split(customCommands, ";")
+		return commandSteps(strings.Split(customCommands, ";"))
 	}
 
-	// 3. Auto-detect based on project type
-	return autoDetectDeployCommands(repoName)
+	// 4. Auto-detect based on project type
+	return commandSteps(autoDetectDeployCommands(config, repoName))
 }
 
-func autoDetectDeployCommands(repoName string) []string {
-	workingDir := getWorkingDirectory(repoName)
+// commandSteps turns plain command lines into pipeline steps
+func commandSteps(commands []string) []Step {
+	steps := make([]Step, 0, len(commands))
+	for _, cmd := range commands {
+		steps = append(steps, Step{Run: cmd})
+	}
+	return steps
+}
+
+func autoDetectDeployCommands(config *Config, repoName string) []string {
+	workingDir := getWorkingDirectory(config, repoName)
 	baseCommands := []string{"git pull origin main"}
 
-	// Check for different project types by looking for marker files
+	// Check for different project types by looking for marker files,
+	// unless the pipeline file pins the project type
 	projectTypes := detectProjectType(workingDir)
+	if repoConfig, _ := config.repo(repoName); repoConfig.ProjectType != "" {
+		projectTypes = []string{repoConfig.ProjectType}
+	}
 
 	var buildCommands []string
 	var serviceCommands []string
@@ -566,16 +1035,23 @@ func detectProjectType(workingDir string) []string {
 	return types
 }
 
-func getWorkingDirectory(repoName string) string {
+func getWorkingDirectory(config *Config, repoName string) string {
+	// Check the pipeline file first
+	if repo, ok := config.Repos[strings.ToLower(repoName)]; ok && repo.WorkDir != "" {
+		return repo.WorkDir
+	}
+
 	// Check for repository-specific working directory
-	repoKey := strings.ReplaceAll(strings.ToUpper(repoName), "/", "_")
-	repoKey = strings.ReplaceAll(repoKey, "-", "_")
+	repoKey := repoEnvKey(repoName)
 
 	if workDir := os.Getenv("WORK_DIR_" + repoKey); workDir != "" {
 		return workDir
 	}
 
 	// Check for generic working directory
+	if config.Defaults.WorkDir != "" {
+		return config.Defaults.WorkDir
+	}
 	if workDir := os.Getenv("WORK_DIR"); workDir != "" {
 		return workDir
 	}
@@ -593,14 +1069,39 @@ func getServiceName(repoName, defaultName string) string {
 	return defaultName
 }
 
-func sendDiscordNotification(payload WebhookPayload, success bool, payloadType string) {
+func sendDiscordNotification(config *Config, job *deployJob) {
+	payload, payloadType := job.Payload, job.PayloadType
+	repoConfig, _ := config.repo(payload.Repository.FullName)
+	if env, ok := config.environment(repoConfig, job.Environment); ok && payloadType == "workflow" {
+		// The environment's channel wins over the repository's
+		repoConfig.Notify.DiscordWebhook = firstNonEmpty(env.Notify.DiscordWebhook, repoConfig.Notify.DiscordWebhook)
+		if env.Notify.Enabled != nil {
+			repoConfig.Notify.Enabled = env.Notify.Enabled
+		}
+	}
+	webhookURL := repoConfig.discordWebhook(config.DiscordWebhook)
+	if webhookURL == "" {
+		log.Printf("Discord notifications disabled for %s", payload.Repository.FullName)
+		return
+	}
+
 	log.Printf("Sending Discord notification...")
 
 	color := 0x00ff00 // Green for success
 	status := "✅ Deployment Successful"
-	if !success {
+	switch job.State {
+	case jobFailed:
 		color = 0xff0000 // Red for failure
 		status = "❌ Deployment Failed"
+	case jobTimedOut:
+		color = 0xff8c00 // Orange, killed rather than failed
+		status = "⏱️ Deployment Timed Out"
+	case jobSkipped:
+		color = 0x95a5a6 // Grey, nothing was deployed
+		status = "⏭️ Deployment Skipped"
+	}
+	if rb := job.Rollback; rb != nil && rb.Error == "" {
+		status += ", Rolled Back"
 	}
 
 	var fields []DiscordMessageEmbedField
@@ -643,7 +1144,7 @@ func sendDiscordNotification(payload WebhookPayload, success bool, payloadType s
 			},
 			{
 				Name:   "Commit",
-				Value:  payload.Deployment.Commit[:7],
+				Value:  shortSHA(payload.Deployment.Commit),
 				Inline: true,
 			},
 			{
@@ -662,6 +1163,87 @@ func sendDiscordNotification(payload WebhookPayload, success bool, payloadType s
 				Inline: true,
 			},
 		}
+	} else if payloadType == "release" {
+		// GitHub Release Events
+		title = fmt.Sprintf("%s - Release Deployment", status)
+		release := payload.Release
+		kind := "Release"
+		if release.Prerelease {
+			kind = "Pre-release"
+		}
+		fields = []DiscordMessageEmbedField{
+			{
+				Name:   kind,
+				Value:  fmt.Sprintf("[%s](%s)", firstNonEmpty(release.Name, release.TagName), release.HTMLURL),
+				Inline: true,
+			},
+			{
+				Name:   "Tag",
+				Value:  release.TagName,
+				Inline: true,
+			},
+			{
+				Name:   "Author",
+				Value:  firstNonEmpty(release.Author.Login, payload.Sender.Login),
+				Inline: true,
+			},
+		}
+	} else if payloadType == "workflow_run" {
+		// GitHub Actions runs that concluded successfully
+		title = fmt.Sprintf("%s - CI Deployment", status)
+		run := payload.WorkflowRun
+		fields = []DiscordMessageEmbedField{
+			{
+				Name:   "Workflow",
+				Value:  fmt.Sprintf("[%s #%d](%s)", run.Name, run.RunNumber, run.HTMLURL),
+				Inline: true,
+			},
+			{
+				Name:   "Branch",
+				Value:  run.HeadBranch,
+				Inline: true,
+			},
+			{
+				Name:   "Commit",
+				Value:  fmt.Sprintf("[%s](%s)", shortSHA(payload.HeadCommit.ID), payload.HeadCommit.URL),
+				Inline: true,
+			},
+			{
+				Name:   "Run Triggered By",
+				Value:  fmt.Sprintf("%s by %s", run.Event, firstNonEmpty(run.Actor.Login, payload.Sender.Login)),
+				Inline: true,
+			},
+			{
+				Name:   "Message",
+				Value:  payload.HeadCommit.Message,
+				Inline: false,
+			},
+		}
+	} else if job.Provider == "github" && strings.HasPrefix(payload.Ref, "refs/tags/") {
+		// GitHub tag pushes; other providers announce tags as a Code Deployment
+		title = fmt.Sprintf("%s - Tag Deployment", status)
+		fields = []DiscordMessageEmbedField{
+			{
+				Name:   "Tag",
+				Value:  strings.TrimPrefix(payload.Ref, "refs/tags/"),
+				Inline: true,
+			},
+			{
+				Name:   "Commit",
+				Value:  fmt.Sprintf("[%s](%s)", shortSHA(payload.HeadCommit.ID), payload.HeadCommit.URL),
+				Inline: true,
+			},
+			{
+				Name:   "Author",
+				Value:  payload.Pusher.Name,
+				Inline: true,
+			},
+			{
+				Name:   "Message",
+				Value:  payload.HeadCommit.Message,
+				Inline: false,
+			},
+		}
 	} else {
 		// GitHub Push Events
 		title = fmt.Sprintf("%s - Code Deployment", status)
@@ -673,7 +1255,7 @@ func sendDiscordNotification(payload WebhookPayload, success bool, payloadType s
 			},
 			{
 				Name:   "Commit",
-				Value:  fmt.Sprintf("[%s](%s)", payload.HeadCommit.ID[:7], payload.HeadCommit.URL),
+				Value:  fmt.Sprintf("[%s](%s)", shortSHA(payload.HeadCommit.ID), payload.HeadCommit.URL),
 				Inline: true,
 			},
 			{
@@ -689,9 +1271,65 @@ func sendDiscordNotification(payload WebhookPayload, success bool, payloadType s
 		}
 	}
 
+	if job.Readiness != nil {
+		fields = append(fields, DiscordMessageEmbedField{
+			Name:  "Readiness",
+			Value: truncateOutput(job.Readiness.summary(), 1000),
+		})
+	}
+	if crash := job.Crash; crash != nil {
+		fields = append(fields, DiscordMessageEmbedField{Name: "Container", Value: crash.Container + " " + crash.Reason})
+		if crash.Logs != "" {
+			fields = append(fields, DiscordMessageEmbedField{
+				Name:  "Last Log Lines",
+				Value: "```\n" + truncateOutput(crash.Logs, 900) + "\n```",
+			})
+		}
+	}
+	if job.Trigger != "" {
+		fields = append(fields, DiscordMessageEmbedField{
+			Name:  "Triggered By",
+			Value: fmt.Sprintf("%s of deployment %s (API)", job.Trigger, job.SourceID),
+		})
+	}
+
+	description := fmt.Sprintf("Repository: **%s**", payload.Repository.FullName)
+	state := job.State
+	if rb := job.Rollback; rb != nil {
+		if rb.Error == "" {
+			state += ", rolled back to " + rb.To
+		} else {
+			state += ", rollback to " + rb.To + " failed"
+		}
+		if rb.Error == "" {
+			fields = append(fields, DiscordMessageEmbedField{Name: "Rolled Back To", Value: rb.Image})
+		} else {
+			fields = append(fields,
+				DiscordMessageEmbedField{Name: "Rollback Target", Value: rb.Image},
+				DiscordMessageEmbedField{Name: "Rollback Error", Value: truncateOutput(rb.Error, 1000)})
+		}
+	} else if (job.State == jobFailed || job.State == jobTimedOut) && !payload.deploysImage() {
+		fields = append(fields, DiscordMessageEmbedField{
+			Name:  "Rollback",
+			Value: "None, source deployments are not rolled back automatically",
+		})
+	}
+	if job.Reason != "" {
+		description += fmt.Sprintf("\n**%s** (%s)", state, job.Reason)
+	}
+
+	// Discord rejects fields without a value, e.g. the branch of a registry push
+	kept := fields[:0]
+	for _, field := range fields {
+		if strings.TrimSpace(field.Value) != "" {
+			kept = append(kept, field)
+		}
+	}
+	fields = kept
+
 	embed := DiscordMessageEmbed{
 		Title:       title,
-		Description: fmt.Sprintf("Repository: **%s**", payload.Repository.FullName),
+		Description: description,
 		Color:       color,
 		Fields:      fields,
 		Footer: &DiscordMessageEmbedFooter{
@@ -710,7 +1348,7 @@ func sendDiscordNotification(payload WebhookPayload, success bool, payloadType s
 		return
 	}
 
-	resp, err := http.Post(config.DiscordWebhook, "application/json", strings.NewReader(string(jsonData)))
+	resp, err := http.Post(webhookURL, "application/json", strings.NewReader(string(jsonData)))
 	if err != nil {
 		log.Printf("Error sending Discord notification: %v", err)
 		return
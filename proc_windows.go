@@ -0,0 +1,9 @@
+//go:build windows
+
+package main
+
+import "os/exec"
+
+// killProcessGroupOnCancel is a no-op on Windows, where there are no process
+// groups to signal; cancellation kills the command itself.
+func killProcessGroupOnCancel(cmd *exec.Cmd) {}
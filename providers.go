@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// deployEvent is the canonical form of a deployment trigger. Providers turn
+// the webhooks of their source into one, so the handler and the queue never
+// look at provider-specific headers or payloads.
+type deployEvent struct {
+	Provider    string // provider that parsed the request, e.g. "github"
+	Type        string // payload type of the job: "push", "release", "workflow_run", "package" or "workflow"
+	Repository  string // owner/name, the key of the pipeline config; "" until routeImage for registry events
+	Ref         string // git ref, e.g. refs/heads/main; "" when the event has none
+	Commit      string // commit, or package version
+	Author      string
+	Image       string // image a Docker deployment runs, "" for source deployments
+	Environment string // "" deploys to the repository's default environment
+	Workflow    string // CI workflow whose successful run is the trigger, "" for other events
+	DeliveryID  string // id of the webhook delivery, "" when the source sends none
+
+	// Refs lists every ref a push updated, in payload order, for sources
+	// that report several per push; routeRef picks the one to deploy
+	Refs []pushedRef
+
+	// Payload is what the deployment runs. Providers fill in the GitHub
+	// layout that planDeployment and the notifications read.
+	Payload WebhookPayload
+}
+
+// pushedRef is one branch or tag a push moved
+type pushedRef struct {
+	Ref     string // e.g. refs/heads/main
+	Commit  string
+	Message string // of the commit, "" when the payload has none
+	URL     string
+}
+
+// useRef makes ref the one the event deploys
+func (e *deployEvent) useRef(ref pushedRef) {
+	e.Ref, e.Commit = ref.Ref, ref.Commit
+	e.Payload.Ref = ref.Ref
+	e.Payload.HeadCommit.ID = ref.Commit
+	e.Payload.HeadCommit.Message = ref.Message
+	e.Payload.HeadCommit.URL = ref.URL
+}
+
+// routeRef picks the ref a push of several refs deploys: the first one the
+// repository's branch and tag filters allow, or else the first one, whose
+// skip reason is then reported
+func routeRef(config *Config, event *deployEvent) {
+	if len(event.Refs) < 2 {
+		return
+	}
+	rc, _ := config.repo(event.Repository)
+	for _, ref := range event.Refs {
+		candidate := *event
+		candidate.useRef(ref)
+		if rc.skipReason(candidate) == "" {
+			*event = candidate
+			return
+		}
+	}
+	event.useRef(event.Refs[0])
+}
+
+// branch returns the branch the event deploys, "" when it has no ref or
+// deploys a tag
+func (e deployEvent) branch() string {
+	if e.tag() != "" {
+		return ""
+	}
+	return strings.TrimPrefix(e.Ref, "refs/heads/")
+}
+
+// tag returns the tag the event deploys, "" when it deploys no tag
+func (e deployEvent) tag() string {
+	if !strings.HasPrefix(e.Ref, "refs/tags/") {
+		return ""
+	}
+	return strings.TrimPrefix(e.Ref, "refs/tags/")
+}
+
+// environment returns the environment the event deploys to. Events that do
+// not name one share the "default" environment of their repository.
+func (e deployEvent) environment() string {
+	return firstNonEmpty(e.Environment, "default")
+}
+
+// provider authenticates and parses the webhooks of one source
+type provider interface {
+	// name identifies the provider in logs and deployment records
+	name() string
+	// match reports whether the request comes from this provider
+	match(r *http.Request, body []byte) bool
+	// authenticate checks the signature or token of the request
+	authenticate(r *http.Request, body []byte, config *Config) error
+	// parse turns an authenticated request into a deploy event. Valid
+	// requests that deploy nothing return an ignoreEvent.
+	parse(r *http.Request, body []byte) (deployEvent, error)
+}
+
+// providers are tried in order. Requests none of them claims are handled as
+// GitHub webhooks, as they were before there were other sources.
+var providers = []provider{
+	workflowProvider{},
+	dockerhubProvider{},
+	harborProvider{},
+	gitlabProvider{},
+	giteaProvider{},
+	bitbucketProvider{},
+	githubProvider{},
+}
+
+func findProvider(r *http.Request, body []byte) provider {
+	for _, p := range providers {
+		if p.match(r, body) {
+			return p
+		}
+	}
+	return githubProvider{}
+}
+
+// replyEvent is returned by parse for requests that are answered with a body
+// of their own instead of deploying, such as the ping sent when a webhook is
+// created
+type replyEvent interface {
+	error
+	reply(config *Config) map[string]interface{}
+}
+
+// ignoreEvent is returned by parse for requests that are fine but deploy
+// nothing. It is the message of the "ignored" response.
+type ignoreEvent string
+
+func (e ignoreEvent) Error() string {
+	return string(e)
+}
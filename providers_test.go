@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newWebhook builds a webhook request; headers are "Name: value" lines
+func newWebhook(body string, headers ...string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/deploy", strings.NewReader(body))
+	for _, header := range headers {
+		name, value, _ := strings.Cut(header, ":")
+		r.Header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	return r
+}
+
+// hmacHex is the hex HMAC-SHA256 of body, as the providers sign it
+func hmacHex(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// parseWebhook runs a request through provider selection and parsing the way
+// deployHandler does, checking that the expected provider claims it
+func parseWebhook(t *testing.T, cfg *Config, want string, r *http.Request, body string) (deployEvent, error) {
+	t.Helper()
+	source := findProvider(r, []byte(body))
+	if source.name() != want {
+		t.Fatalf("provider = %s, want %s", source.name(), want)
+	}
+	event, err := source.parse(r, []byte(body))
+	if err == nil {
+		err = routeImage(cfg, &event)
+		routeRef(cfg, &event)
+	}
+	return event, err
+}
+
+// wantIgnored fails unless err is an ignoreEvent
+func wantIgnored(t *testing.T, err error) {
+	t.Helper()
+	var ignore ignoreEvent
+	if !errors.As(err, &ignore) {
+		t.Errorf("error = %v, want the webhook to be ignored", err)
+	}
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	queueBucket   = "queue"
+	historyBucket = "history"
+)
+
+// Job states
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+	jobTimedOut  = "timed_out"
+	jobSkipped   = "skipped"
+	jobCancelled = "cancelled"
+)
+
+// Finished deployments kept in the history per repository/environment
+const historyPerKey = 50
+
+var errNotCancellable = errors.New("only queued deployments can be cancelled")
+
+var (
+	errQueueFull     = errors.New("deployment queue is full")
+	errRepoQueueFull = errors.New("too many deployments queued for this repository")
+)
+
+// deployJob is one accepted webhook waiting for (or running) its deployment
+type deployJob struct {
+	ID          string           `json:"id"`
+	Repository  string           `json:"repository"`
+	Environment string           `json:"environment"`
+	Provider    string           `json:"provider,omitempty"` // source of the webhook, e.g. "github"
+	PayloadType string           `json:"payload_type"`
+	Payload     WebhookPayload   `json:"payload"`
+	Commit      string           `json:"commit"`
+	State       string           `json:"state"`
+	Reason      string           `json:"reason,omitempty"` // why a job was skipped or did not succeed
+	EnqueuedAt  time.Time        `json:"enqueued_at"`
+	NotBefore   time.Time        `json:"not_before"` // end of the debounce window
+	StartedAt   time.Time        `json:"started_at,omitempty"`
+	FinishedAt  time.Time        `json:"finished_at,omitempty"`
+	Steps       []stepResult     `json:"steps,omitempty"`
+	Image       string           `json:"image,omitempty"`        // image of a Docker deployment
+	ImageDigest string           `json:"image_digest,omitempty"` // registry digest of the pulled image
+	Readiness   *readinessResult `json:"readiness,omitempty"`    // result of the readiness check
+	Crash       *crashReport     `json:"crash,omitempty"`        // container that did not stay up
+	Rollback    *rollbackResult  `json:"rollback,omitempty"`     // set when a failure was rolled back
+	Trigger     string           `json:"trigger,omitempty"`      // "redeploy" or "rollback" for jobs queued through the API
+	SourceID    string           `json:"source_id,omitempty"`    // deployment whose payload a redeploy or rollback runs again
+}
+
+// queueErrorStatus maps an enqueue error to the HTTP status of the rejection
+func queueErrorStatus(err error) int {
+	switch err {
+	case errQueueFull:
+		return http.StatusServiceUnavailable
+	case errRepoQueueFull:
+		return http.StatusTooManyRequests
+	}
+	return http.StatusInternalServerError
+}
+
+// key groups jobs that must never run at the same time
+func (j *deployJob) key() string {
+	return strings.ToLower(j.Repository) + "|" + j.Environment
+}
+
+func newJobID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// deployQueue runs jobs one at a time per repository/environment and at most
+// Queue.MaxWorkers at once overall. Waiting and running jobs are persisted so
+// they survive a restart. Limits are read from the active config, so they
+// follow configuration reloads.
+type deployQueue struct {
+	mu      sync.Mutex
+	store   *fileStore
+	queued  []*deployJob
+	running map[string]*deployJob // by job key
+	paused  bool
+	wake    chan struct{}
+	run     func(job deployJob, setPhase func(string)) string
+	skipped func(job *deployJob)
+}
+
+var jobQueue *deployQueue
+
+// newDeployQueue restores persisted jobs and starts dispatching. run executes
+// a job and returns its final state, or jobRunning when shutdown abandoned it;
+// skipped is called for superseded jobs.
+func newDeployQueue(store *fileStore, run func(job deployJob, setPhase func(string)) string, skipped func(job *deployJob)) (*deployQueue, error) {
+	q := &deployQueue{
+		store:   store,
+		running: make(map[string]*deployJob),
+		wake:    make(chan struct{}, 1),
+		run:     run,
+		skipped: skipped,
+	}
+
+	// Jobs that were running when the process died start over
+	for _, id := range store.keys(queueBucket) {
+		var job deployJob
+		if _, err := store.get(queueBucket, id, &job); err != nil {
+			return nil, err
+		}
+		if job.State == jobRunning {
+			log.Printf("Re-queueing deployment %s of %s interrupted by a restart", job.ID, job.Repository)
+			job.State = jobQueued
+			job.StartedAt = time.Time{}
+			job.Steps = nil
+			job.Image, job.ImageDigest = "", ""
+			job.Readiness, job.Crash, job.Rollback = nil, nil, nil
+			if err := store.put(queueBucket, job.ID, &job); err != nil {
+				return nil, err
+			}
+		}
+		q.queued = append(q.queued, &job)
+	}
+	sort.SliceStable(q.queued, func(i, k int) bool {
+		return q.queued[i].EnqueuedAt.Before(q.queued[k].EnqueuedAt)
+	})
+	if len(q.queued) > 0 {
+		log.Printf("Restored %d queued deployment(s)", len(q.queued))
+	}
+
+	// Jobs still in their debounce window need a wake-up when it ends
+	for _, job := range q.queued {
+		if wait := time.Until(job.NotBefore); wait > 0 {
+			time.AfterFunc(wait, q.notify)
+		}
+	}
+
+	go q.dispatch()
+	q.notify()
+	return q, nil
+}
+
+// enqueue persists a job and schedules it. It fails with errQueueFull or
+// errRepoQueueFull when the configured limits are reached.
+//
+// With a debounce window configured the job waits that long before it may
+// start, and any job of the same repository/environment that has not started
+// yet is superseded by it: only the newest commit gets deployed.
+func (q *deployQueue) enqueue(job *deployJob) error {
+	limits := getConfig().Queue
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var superseded []*deployJob
+	remaining := make([]*deployJob, 0, len(q.queued))
+	for _, queued := range q.queued {
+		if limits.Debounce > 0 && queued.key() == job.key() {
+			superseded = append(superseded, queued)
+		} else {
+			remaining = append(remaining, queued)
+		}
+	}
+
+	if len(remaining) >= limits.MaxQueued {
+		return errQueueFull
+	}
+	sameKey := 0
+	for _, queued := range remaining {
+		if queued.key() == job.key() {
+			sameKey++
+		}
+	}
+	if sameKey >= limits.MaxPerRepo {
+		return errRepoQueueFull
+	}
+
+	// A redelivered webhook keeps its delivery id; checked under q.mu so two
+	// deliveries with the same id never share a record
+	if q.taken(job.ID) {
+		job.ID += "-" + newJobID()[:6]
+	}
+	job.State = jobQueued
+	job.EnqueuedAt = time.Now().UTC()
+	// Webhooks wait for more pushes; manual redeploys and rollbacks start right away
+	job.NotBefore = job.EnqueuedAt
+	if job.Trigger == "" {
+		job.NotBefore = job.NotBefore.Add(limits.Debounce)
+	}
+	if err := q.store.put(queueBucket, job.ID, job); err != nil {
+		return err
+	}
+	q.queued = append(remaining, job)
+
+	for _, old := range superseded {
+		old.State = jobSkipped
+		old.Reason = "superseded by " + shortSHA(job.Commit)
+		old.FinishedAt = job.EnqueuedAt
+		log.Printf("Deployment %s of %s %s (%s)", old.ID, old.Repository, old.State, old.Reason)
+		q.finish(old)
+		go q.skipped(old.snapshot())
+	}
+
+	if limits.Debounce > 0 {
+		time.AfterFunc(limits.Debounce, q.notify)
+	}
+	q.notify()
+	return nil
+}
+
+// finish moves a job from the queue to the history, ends its live log and
+// prunes the oldest history entries of its repository/environment; q.mu must
+// be held
+func (q *deployQueue) finish(job *deployJob) {
+	deployLogs.finish(job.ID, job.State)
+	if err := q.store.put(historyBucket, job.ID, job); err != nil {
+		log.Printf("Error recording deployment %s in history: %v", job.ID, err)
+	}
+	if err := q.store.delete(queueBucket, job.ID); err != nil {
+		log.Printf("Error removing deployment %s from the queue: %v", job.ID, err)
+	}
+
+	history := q.history(func(j *deployJob) bool { return j.key() == job.key() })
+	for _, old := range history[min(len(history), historyPerKey):] {
+		if err := q.store.delete(historyBucket, old.ID); err != nil {
+			log.Printf("Error pruning deployment %s from history: %v", old.ID, err)
+		}
+	}
+}
+
+// history returns finished jobs matching filter, newest first; q.mu must be held
+func (q *deployQueue) history(filter func(j *deployJob) bool) []*deployJob {
+	var jobs []*deployJob
+	for _, id := range q.store.keys(historyBucket) {
+		var job deployJob
+		if _, err := q.store.get(historyBucket, id, &job); err != nil {
+			log.Printf("Error reading deployment %s from history: %v", id, err)
+			continue
+		}
+		if filter(&job) {
+			jobs = append(jobs, &job)
+		}
+	}
+	sort.Slice(jobs, func(i, k int) bool {
+		return jobs[i].EnqueuedAt.After(jobs[k].EnqueuedAt)
+	})
+	return jobs
+}
+
+// snapshot returns a copy of the job that is safe to use outside q.mu
+func (j *deployJob) snapshot() *deployJob {
+	c := *j
+	c.Steps = append([]stepResult(nil), j.Steps...)
+	return &c
+}
+
+// find returns the queued or running job with the given id; q.mu must be held
+func (q *deployQueue) find(id string) *deployJob {
+	for _, job := range q.queued {
+		if job.ID == id {
+			return job
+		}
+	}
+	for _, job := range q.running {
+		if job.ID == id {
+			return job
+		}
+	}
+	return nil
+}
+
+// lookup returns a copy of a queued, running or finished deployment
+func (q *deployQueue) lookup(id string) (deployJob, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if job := q.find(id); job != nil {
+		return *job.snapshot(), true
+	}
+	var job deployJob
+	found, err := q.store.get(historyBucket, id, &job)
+	if err != nil {
+		log.Printf("Error reading deployment %s from history: %v", id, err)
+	}
+	return job, found && err == nil
+}
+
+// list returns deployments of a repository and/or environment, newest first:
+// queued and running jobs, then the history. Empty filters match everything.
+func (q *deployQueue) list(repo, env string) []deployJob {
+	match := func(j *deployJob) bool {
+		return (repo == "" || strings.EqualFold(j.Repository, repo)) && (env == "" || j.Environment == env)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var active []*deployJob
+	for _, job := range q.queued {
+		if match(job) {
+			active = append(active, job.snapshot())
+		}
+	}
+	for _, job := range q.running {
+		if match(job) {
+			active = append(active, job.snapshot())
+		}
+	}
+	sort.Slice(active, func(i, k int) bool {
+		return active[i].EnqueuedAt.After(active[k].EnqueuedAt)
+	})
+
+	jobs := make([]deployJob, 0, len(active))
+	for _, job := range append(active, q.history(match)...) {
+		jobs = append(jobs, *job)
+	}
+	return jobs
+}
+
+// taken reports whether a deployment id is already in use; q.mu must be held
+func (q *deployQueue) taken(id string) bool {
+	if q.find(id) != nil {
+		return true
+	}
+	var job deployJob
+	found, _ := q.store.get(historyBucket, id, &job)
+	return found
+}
+
+// update applies fn to a queued or running job and persists it
+func (q *deployQueue) update(id string, fn func(j *deployJob)) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job := q.find(id)
+	if job == nil {
+		return
+	}
+	fn(job)
+	if err := q.store.put(queueBucket, job.ID, job); err != nil {
+		log.Printf("Error persisting deployment %s: %v", job.ID, err)
+	}
+}
+
+// cancel drops a job that has not started yet
+func (q *deployQueue) cancel(id string) (deployJob, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i, job := range q.queued {
+		if job.ID != id {
+			continue
+		}
+		q.queued = append(q.queued[:i], q.queued[i+1:]...)
+		job.State = jobCancelled
+		job.FinishedAt = time.Now().UTC()
+		q.finish(job)
+		return *job.snapshot(), nil
+	}
+	return deployJob{}, errNotCancellable
+}
+
+// pause stops new jobs from starting. Queued jobs stay persisted for the next
+// start; the number of them is returned.
+func (q *deployQueue) pause() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.paused = true
+	return len(q.queued)
+}
+
+func (q *deployQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *deployQueue) dispatch() {
+	for range q.wake {
+		q.startEligible()
+	}
+}
+
+// startEligible starts queued jobs in FIFO order as long as workers are free,
+// skipping jobs still in their debounce window and jobs whose
+// repository/environment already has one running.
+func (q *deployQueue) startEligible() {
+	maxWorkers := getConfig().Queue.MaxWorkers
+	now := time.Now()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	remaining := q.queued[:0]
+	for _, job := range q.queued {
+		_, busy := q.running[job.key()]
+		if q.paused || busy || len(q.running) >= maxWorkers || now.Before(job.NotBefore) {
+			remaining = append(remaining, job)
+			continue
+		}
+
+		// Register with the shutdown tracker while holding q.mu, so pause()
+		// followed by inflight.drain() can never miss a job that just started
+		taskID, ok := inflight.start(job.Repository, "deploying")
+		if !ok {
+			q.paused = true
+			remaining = append(remaining, job)
+			continue
+		}
+
+		job.State = jobRunning
+		job.StartedAt = time.Now().UTC()
+		if err := q.store.put(queueBucket, job.ID, job); err != nil {
+			log.Printf("Error persisting deployment %s: %v", job.ID, err)
+		}
+		q.running[job.key()] = job
+		go q.execute(job.snapshot(), taskID)
+	}
+	q.queued = remaining
+}
+
+// execute runs a job on its own goroutine. The runner gets a copy; changes to
+// the record go through update so readers never see a half-written job.
+func (q *deployQueue) execute(job *deployJob, taskID int) {
+	defer inflight.done(taskID)
+	state := q.run(*job, func(phase string) { inflight.setPhase(taskID, phase) })
+	if state == jobRunning {
+		// Abandoned by shutdown; the persisted record re-queues it on restart
+		return
+	}
+
+	q.mu.Lock()
+	running := q.running[job.key()]
+	running.State = state
+	running.FinishedAt = time.Now().UTC()
+	delete(q.running, job.key())
+	q.finish(running)
+	q.mu.Unlock()
+	q.notify()
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ReadinessCheck is probed over HTTP after the deployment commands. The
+// deployment only succeeds once a response passes it.
+type ReadinessCheck struct {
+	URL          string        `yaml:"url"`           // no check without one
+	ExpectStatus []int         `yaml:"expect_status"` // default any 2xx
+	ExpectBody   string        `yaml:"expect_body"`   // regular expression the response body must match
+	Retries      int           `yaml:"retries"`       // attempts after the first, default 10
+	Interval     time.Duration `yaml:"interval"`      // between attempts, default 3s
+	Timeout      time.Duration `yaml:"timeout"`       // of one request, default 5s
+}
+
+// readinessResult is the outcome of the readiness check of a deployment
+type readinessResult struct {
+	URL        string `json:"url"`
+	Passed     bool   `json:"passed"`
+	Attempts   int    `json:"attempts"`
+	Status     int    `json:"status,omitempty"` // HTTP status of the last response
+	Detail     string `json:"detail"`           // what the last attempt saw
+	DurationMs int64  `json:"duration_ms"`
+}
+
+// Bytes of a response body matched against expect_body
+const maxReadinessBody = 64 * 1024
+
+func (c ReadinessCheck) merge(over ReadinessCheck) ReadinessCheck {
+	c.URL = firstNonEmpty(over.URL, c.URL)
+	c.ExpectBody = firstNonEmpty(over.ExpectBody, c.ExpectBody)
+	if over.ExpectStatus != nil {
+		c.ExpectStatus = over.ExpectStatus
+	}
+	if over.Retries != 0 {
+		c.Retries = over.Retries
+	}
+	if over.Interval != 0 {
+		c.Interval = over.Interval
+	}
+	if over.Timeout != 0 {
+		c.Timeout = over.Timeout
+	}
+	return c
+}
+
+// validate reports the mistakes in a (possibly partial) readiness section
+func (c ReadinessCheck) validate(where string) []error {
+	var errs []error
+	if c.URL != "" {
+		if u, err := url.Parse(c.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("%s.url: %q is not an http(s) URL", where, c.URL))
+		}
+	}
+	for _, status := range c.ExpectStatus {
+		if status < 100 || status > 599 {
+			errs = append(errs, fmt.Errorf("%s.expect_status: %d is not an HTTP status", where, status))
+		}
+	}
+	if _, err := regexp.Compile(c.ExpectBody); err != nil {
+		errs = append(errs, fmt.Errorf("%s.expect_body: %w", where, err))
+	}
+	if c.Retries < 0 || c.Interval < 0 || c.Timeout < 0 {
+		errs = append(errs, fmt.Errorf("%s: retries, interval and timeout must not be negative", where))
+	}
+	return errs
+}
+
+// readinessStep checks the deployed service after the commands. The result
+// is passed to run.onReadiness for the deployment record.
+func readinessStep(check ReadinessCheck) Step {
+	if check.Retries == 0 {
+		check.Retries = 10
+	}
+	if check.Interval == 0 {
+		check.Interval = 3 * time.Second
+	}
+	if check.Timeout == 0 {
+		check.Timeout = 5 * time.Second
+	}
+	return Step{
+		Name: "readiness",
+		Run:  "GET " + check.URL + " (readiness check)",
+		call: func(ctx context.Context, out io.Writer, run *deployRun) error {
+			result := check.wait(ctx, out)
+			if run.onReadiness != nil {
+				run.onReadiness(result)
+			}
+			if !result.Passed {
+				return fmt.Errorf("not ready after %d attempts: %s", result.Attempts, result.Detail)
+			}
+			return nil
+		},
+	}
+}
+
+// wait probes the URL until a response passes, the retries run out or ctx ends
+func (c ReadinessCheck) wait(ctx context.Context, out io.Writer) readinessResult {
+	started := time.Now()
+	result := readinessResult{URL: c.URL}
+	client := &http.Client{Timeout: c.Timeout}
+	body := regexp.MustCompile(c.ExpectBody) // validated with the config
+
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+	for {
+		result.Attempts++
+		result.Status, result.Detail, result.Passed = c.probe(ctx, client, body)
+		fmt.Fprintf(out, "Attempt %d: %s\n", result.Attempts, result.Detail)
+		if result.Passed || result.Attempts > c.Retries || !waitTick(ctx, ticker) {
+			break
+		}
+	}
+	result.DurationMs = time.Since(started).Milliseconds()
+	return result
+}
+
+// waitTick waits for the next tick and reports false when ctx ended first
+func waitTick(ctx context.Context, ticker *time.Ticker) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-ticker.C:
+		return true
+	}
+}
+
+// probe sends one request and reports the status, what was seen and whether
+// the response passes the check
+func (c ReadinessCheck) probe(ctx context.Context, client *http.Client, body *regexp.Regexp) (int, string, bool) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.URL, nil)
+	if err != nil {
+		return 0, err.Error(), false
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err.Error(), false
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxReadinessBody))
+	if err != nil {
+		return resp.StatusCode, fmt.Sprintf("%s, reading the body: %v", resp.Status, err), false
+	}
+
+	if !c.expectsStatus(resp.StatusCode) {
+		return resp.StatusCode, fmt.Sprintf("%s, expected %s", resp.Status, c.expectedStatus()), false
+	}
+	if c.ExpectBody != "" && !body.Match(data) {
+		return resp.StatusCode, fmt.Sprintf("%s, body does not match %q", resp.Status, c.ExpectBody), false
+	}
+	return resp.StatusCode, resp.Status, true
+}
+
+func (c ReadinessCheck) expectsStatus(status int) bool {
+	if len(c.ExpectStatus) == 0 {
+		return status >= 200 && status < 300
+	}
+	for _, expected := range c.ExpectStatus {
+		if status == expected {
+			return true
+		}
+	}
+	return false
+}
+
+func (c ReadinessCheck) expectedStatus() string {
+	if len(c.ExpectStatus) == 0 {
+		return "2xx"
+	}
+	statuses := make([]string, len(c.ExpectStatus))
+	for i, status := range c.ExpectStatus {
+		statuses[i] = fmt.Sprint(status)
+	}
+	return strings.Join(statuses, " or ")
+}
+
+// summary describes the result for notifications
+func (r readinessResult) summary() string {
+	verdict := "✅ ready"
+	if !r.Passed {
+		verdict = "❌ not ready"
+	}
+	return fmt.Sprintf("%s after %d attempt(s), %.1fs\n%s: %s", verdict, r.Attempts, float64(r.DurationMs)/1000, r.URL, r.Detail)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// ImageTrigger deploys a repository when a registry webhook reports a push
+// of a matching image. The image runs like the one of a workflow payload.
+type ImageTrigger struct {
+	Image       string   `yaml:"image"`       // repository without tag, e.g. harbor.company.com/company/api
+	Tags        []string `yaml:"tags"`        // path.Match globs, default every tag
+	Environment string   `yaml:"environment"` // environment the image is deployed to
+}
+
+// validate reports the mistakes in one image_triggers entry
+func (t ImageTrigger) validate(where string, environments map[string]EnvironmentConfig) []error {
+	var errs []error
+	if _, err := parseImageRef(t.Image); err != nil {
+		errs = append(errs, fmt.Errorf("%s.image: %w", where, err))
+	} else if strings.ContainsRune(t.Image, '@') || strings.LastIndexByte(t.Image, ':') > strings.LastIndexByte(t.Image, '/') {
+		errs = append(errs, fmt.Errorf("%s.image: %q must not have a tag or digest, use tags", where, t.Image))
+	}
+	for _, pattern := range t.Tags {
+		if _, err := path.Match(pattern, ""); err != nil {
+			errs = append(errs, fmt.Errorf("%s.tags: invalid pattern %q", where, pattern))
+		}
+	}
+	if t.Environment == "" {
+		errs = append(errs, fmt.Errorf("%s.environment: is required", where))
+	} else if _, ok := environments[t.Environment]; !ok {
+		errs = append(errs, fmt.Errorf("%s.environment: %q is not in the environments registry", where, t.Environment))
+	}
+	return errs
+}
+
+// matches reports whether the trigger deploys ref
+func (t ImageTrigger) matches(ref imageRef) bool {
+	want, err := parseImageRef(t.Image)
+	if err != nil || want.Repository() != ref.Repository() {
+		return false
+	}
+	if len(t.Tags) == 0 {
+		return true
+	}
+	for _, pattern := range t.Tags {
+		if ok, _ := path.Match(pattern, ref.Tag); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// imageTarget finds the repository and trigger that deploy ref. Repositories
+// are searched in name order and the first matching trigger wins.
+func (c *Config) imageTarget(ref imageRef) (string, ImageTrigger, bool) {
+	for _, name := range c.repoNames() {
+		for _, trigger := range c.Repos[name].ImageTriggers {
+			if trigger.matches(ref) {
+				return name, trigger, true
+			}
+		}
+	}
+	return "", ImageTrigger{}, false
+}
+
+// routeImage points a registry event, which names only an image, at the
+// repository and environment of the image_triggers entry it matches. Events
+// that already name a repository are left alone.
+func routeImage(config *Config, event *deployEvent) error {
+	if event.Repository != "" || event.Image == "" {
+		return nil
+	}
+	ref, err := parseImageRef(event.Image)
+	if err != nil {
+		return fmt.Errorf("image %q: %w", event.Image, err)
+	}
+	repo, trigger, ok := config.imageTarget(ref)
+	if !ok {
+		return ignoreEvent(fmt.Sprintf("No image_triggers entry matches %s", ref))
+	}
+	event.Repository = repo
+	event.Environment = trigger.Environment
+	event.Payload.Repository.Name = repo[strings.LastIndex(repo, "/")+1:]
+	event.Payload.Repository.FullName = repo
+	event.Payload.Deployment.Environment = trigger.Environment
+	return nil
+}
+
+// registryEvent builds the event of a pushed image. The Docker fields are
+// filled in like a workflow payload's, so the same validation and
+// pull-and-restart steps apply.
+func registryEvent(provider, image, pusher string) (deployEvent, error) {
+	ref, err := parseImageRef(image)
+	if err != nil {
+		return deployEvent{}, fmt.Errorf("image %q: %w", image, err)
+	}
+	event := deployEvent{
+		Provider: provider,
+		Type:     "workflow",
+		Commit:   ref.Tag,
+		Author:   pusher,
+		Image:    ref.String(),
+	}
+	docker := &event.Payload.Docker
+	docker.Registry = ref.Registry
+	docker.ImageName = ref.Path
+	docker.LatestTag = ref.Tag
+	docker.LatestImage = ref.String()
+	event.Payload.Pusher.Name = pusher
+	return event, nil
+}
+
+// dockerhubProvider handles Docker Hub repository webhooks. Docker Hub
+// neither signs payloads nor sends custom headers, so the webhook URL
+// carries a token: /deploy?token=<server.dockerhub_token>.
+type dockerhubProvider struct{}
+
+type dockerhubPayload struct {
+	PushData struct {
+		Tag    string `json:"tag"`
+		Pusher string `json:"pusher"`
+	} `json:"push_data"`
+	Repository struct {
+		RepoName string `json:"repo_name"` // e.g. company/api
+	} `json:"repository"`
+}
+
+func (dockerhubProvider) name() string { return "dockerhub" }
+
+func (dockerhubProvider) match(r *http.Request, body []byte) bool {
+	var payload struct {
+		PushData   *json.RawMessage `json:"push_data"`
+		Repository *json.RawMessage `json:"repository"`
+	}
+	return json.Unmarshal(body, &payload) == nil && payload.PushData != nil && payload.Repository != nil
+}
+
+func (dockerhubProvider) authenticate(r *http.Request, body []byte, config *Config) error {
+	if config.DockerHubToken == "" {
+		return errors.New("server.dockerhub_token is not set")
+	}
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		return errors.New("no token in the webhook URL")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(config.DockerHubToken)) != 1 {
+		return errors.New("token does not match")
+	}
+	return nil
+}
+
+func (p dockerhubProvider) parse(r *http.Request, body []byte) (deployEvent, error) {
+	var payload dockerhubPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return deployEvent{}, fmt.Errorf("invalid JSON payload: %w", err)
+	}
+	if payload.Repository.RepoName == "" {
+		return deployEvent{}, errors.New("payload has no repository.repo_name")
+	}
+	if payload.PushData.Tag == "" {
+		return deployEvent{}, ignoreEvent("Push has no tag, nothing to deploy")
+	}
+	image := defaultRegistry + "/" + payload.Repository.RepoName + ":" + payload.PushData.Tag
+	return registryEvent(p.name(), image, payload.PushData.Pusher)
+}
+
+// harborProvider handles Harbor webhooks. Harbor sends the Auth Header of
+// the webhook policy verbatim in Authorization; only PUSH_ARTIFACT deploys.
+type harborProvider struct{}
+
+type harborPayload struct {
+	Type      string `json:"type"`
+	Operator  string `json:"operator"`
+	EventData struct {
+		Resources []struct {
+			Tag         string `json:"tag"`
+			ResourceURL string `json:"resource_url"` // e.g. harbor.company.com/company/api:1.4.2
+		} `json:"resources"`
+	} `json:"event_data"`
+}
+
+func (harborProvider) name() string { return "harbor" }
+
+func (harborProvider) match(r *http.Request, body []byte) bool {
+	var payload struct {
+		Type      string           `json:"type"`
+		EventData *json.RawMessage `json:"event_data"`
+	}
+	return json.Unmarshal(body, &payload) == nil && payload.Type != "" && payload.EventData != nil
+}
+
+func (harborProvider) authenticate(r *http.Request, body []byte, config *Config) error {
+	if config.HarborAuth == "" {
+		return errors.New("server.harbor_auth is not set")
+	}
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		return errors.New("no Authorization header")
+	}
+	if subtle.ConstantTimeCompare([]byte(auth), []byte(config.HarborAuth)) != 1 {
+		return errors.New("Authorization header does not match")
+	}
+	return nil
+}
+
+func (p harborProvider) parse(r *http.Request, body []byte) (deployEvent, error) {
+	var payload harborPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return deployEvent{}, fmt.Errorf("invalid JSON payload: %w", err)
+	}
+	if payload.Type != "PUSH_ARTIFACT" {
+		return deployEvent{}, ignoreEvent(fmt.Sprintf("Unsupported Harbor event %q", payload.Type))
+	}
+
+	// An artifact pushed with several tags lists one resource per tag
+	image := ""
+	for _, resource := range payload.EventData.Resources {
+		if resource.Tag != "" && resource.ResourceURL != "" {
+			image = resource.ResourceURL
+		}
+	}
+	if image == "" {
+		return deployEvent{}, ignoreEvent("Artifact was pushed without a tag, nothing to deploy")
+	}
+	return registryEvent(p.name(), image, payload.Operator)
+}
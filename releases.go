@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Store bucket of the last successful deployment per repository/environment
+const releaseBucket = "releases"
+
+// release is what a repository environment last deployed successfully, and
+// what a failed deployment rolls back to
+type release struct {
+	DeploymentID string         `json:"deployment_id"`
+	Repository   string         `json:"repository"`
+	Environment  string         `json:"environment"`
+	Version      string         `json:"version"`         // versioned tag or short commit, e.g. main-abc1234
+	Image        string         `json:"image,omitempty"` // pinned image, empty when it cannot be redeployed
+	Commit       string         `json:"commit,omitempty"`
+	DeployedAt   time.Time      `json:"deployed_at"`
+	Payload      WebhookPayload `json:"payload"`
+}
+
+// rollbackResult is the automatic rollback of a failed deployment
+type rollbackResult struct {
+	To           string `json:"to"` // version of the release
+	Image        string `json:"image"`
+	DeploymentID string `json:"deployment_id"` // the deployment that released it
+	Error        string `json:"error,omitempty"`
+}
+
+// newRelease describes a successful deployment. Docker images are pinned to
+// the pulled digest, or else to the versioned image, so a rollback gets the
+// very same image back after the latest tag has moved on.
+func newRelease(job deployJob) release {
+	docker := job.Payload.Docker
+	rel := release{
+		DeploymentID: job.ID,
+		Repository:   job.Repository,
+		Environment:  job.Environment,
+		Version:      firstNonEmpty(docker.VersionedTag, shortSHA(job.Commit)),
+		Commit:       job.Commit,
+		DeployedAt:   time.Now().UTC(),
+		Payload:      job.Payload,
+	}
+	if job.Image == "" {
+		return rel
+	}
+	if ref, err := parseImageRef(job.Image); err == nil && job.ImageDigest != "" {
+		ref.Tag, ref.Digest = "", job.ImageDigest
+		rel.Image = ref.String()
+		rel.Version = firstNonEmpty(rel.Version, shortID(job.ImageDigest))
+	} else if docker.VersionedImage != "" {
+		rel.Image = docker.VersionedImage
+	}
+	return rel
+}
+
+func recordRelease(store *fileStore, job deployJob) {
+	rel := newRelease(job)
+	if err := store.put(releaseBucket, job.key(), &rel); err != nil {
+		log.Printf("Error recording release %s of %s: %v", rel.Version, job.Repository, err)
+	}
+}
+
+func lastRelease(store *fileStore, key string) (release, bool) {
+	var rel release
+	ok, err := store.get(releaseBucket, key, &rel)
+	return rel, ok && err == nil
+}
+
+// payload returns the workflow payload that deploys the release again
+func (r release) payload() WebhookPayload {
+	p := r.Payload
+	p.Docker.LatestImage = r.Image
+	p.Docker.LatestTag = ""
+	p.Docker.PullCommand = ""
+	return p
+}
+
+// rollBack redeploys the last release of a failed job's environment. It
+// returns nil when there is nothing to roll back to: a source deployment,
+// whose commands cannot check out an older commit, no earlier release with a
+// pinned image, or the failure happened before the previous version was
+// replaced.
+func rollBack(config *Config, job deployJob, run *deployRun) *rollbackResult {
+	rel, ok := lastRelease(jobQueue.store, job.key())
+	switch {
+	case !job.Payload.deploysImage():
+		log.Printf("Not rolling back %s (%s), source deployments are not rolled back", job.Repository, job.Environment)
+		return nil
+	case !run.disrupted:
+		return nil
+	case !ok || rel.Image == "":
+		log.Printf("No earlier release of %s (%s) to roll back to", job.Repository, job.Environment)
+		return nil
+	}
+
+	result := &rollbackResult{To: rel.Version, Image: rel.Image, DeploymentID: rel.DeploymentID}
+	log.Printf("Rolling back %s (%s) to %s (%s)", job.Repository, job.Environment, rel.Version, rel.Image)
+	run.log.output(0, "stderr", fmt.Sprintf("Deployment failed, rolling back to %s (%s)", rel.Version, rel.Image))
+
+	run.rollback = true
+	run.onImage = nil // the record keeps what failed
+	run.onReadiness, run.onCrash = nil, nil
+	if err := executeDeployment(config, rel.payload(), run); err != nil {
+		log.Printf("Rollback of %s to %s failed: %v", job.Repository, rel.Version, err)
+		result.Error = err.Error()
+	}
+	return result
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// The active configuration. Deployments take a snapshot with getConfig when
+// they start and keep using it, so a reload never changes a running pipeline.
+var activeConfig atomic.Pointer[Config]
+
+func getConfig() *Config {
+	return activeConfig.Load()
+}
+
+func setConfig(cfg *Config) {
+	activeConfig.Store(cfg)
+}
+
+// reloadConfig loads and validates the configuration again and swaps it in
+// only if it is valid; otherwise the running config stays untouched.
+func reloadConfig(reason string) {
+	log.Printf("Reloading configuration (%s)", reason)
+
+	cfg, err := loadConfig()
+	if err == nil {
+		err = cfg.validate()
+	}
+	if err != nil {
+		log.Printf("Configuration reload rejected, keeping previous config: %v", err)
+		return
+	}
+
+	old := getConfig()
+	if old != nil && old.Port != cfg.Port {
+		log.Printf("Warning: port change %s -> %s only takes effect after a restart", old.Port, cfg.Port)
+	}
+	setConfig(cfg)
+	log.Printf("Configuration reloaded (%d repositories)", len(cfg.Repos))
+}
+
+// watchConfig reloads the configuration on SIGHUP and whenever the pipeline
+// file changes on disk. The file is polled (CONFIG_POLL_INTERVAL, default
+// 5s) so it also works for bind mounts where inotify events are unreliable.
+func watchConfig() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	interval, err := time.ParseDuration(getEnv("CONFIG_POLL_INTERVAL", "5s"))
+	if err != nil || interval <= 0 {
+		log.Printf("Invalid CONFIG_POLL_INTERVAL, using 5s")
+		interval = 5 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	file, _ := configPath()
+	last := fileStamp(file)
+
+	for {
+		select {
+		case <-hup:
+			last = fileStamp(file)
+			reloadConfig("SIGHUP")
+		case <-ticker.C:
+			if stamp := fileStamp(file); stamp != last {
+				last = stamp
+				reloadConfig(file + " changed")
+			}
+		}
+	}
+}
+
+// fileStamp identifies a version of a file by size and modification time
+func fileStamp(file string) string {
+	info, err := os.Stat(file)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d/%d", info.ModTime().UnixNano(), info.Size())
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Shell used for steps with shell: true
+const shellPath = "/bin/sh"
+
+var (
+	envAssignmentPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*=`)
+	plainWordPattern     = regexp.MustCompile(`^[A-Za-z0-9_./:=,@%+-]+$`)
+)
+
+// splitCommandLine parses a command the way a POSIX shell splits words, but
+// without running one: single quotes, double quotes and backslash escapes are
+// honoured and leading NAME=value words become environment variables.
+// Pipes, redirects, command lists, substitutions, variable and tilde
+// expansion, globs and comments need a real shell, so they are rejected
+// instead of being passed on as literal arguments.
+func splitCommandLine(line string) (env []string, argv []string, err error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+
+		case c == '\'':
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end < 0 {
+				return nil, nil, fmt.Errorf("unterminated single quote")
+			}
+			word.WriteString(line[i+1 : i+1+end])
+			i += end + 1
+			inWord = true
+
+		case c == '"':
+			i++
+			for ; i < len(line) && line[i] != '"'; i++ {
+				switch {
+				case line[i] == '\\' && i+1 < len(line) && strings.IndexByte("\"\\$`\n", line[i+1]) >= 0:
+					i++
+					if line[i] != '\n' {
+						word.WriteByte(line[i])
+					}
+				case line[i] == '$' || line[i] == '`':
+					return nil, nil, shellOnly(string(line[i]), "expansion")
+				default:
+					word.WriteByte(line[i])
+				}
+			}
+			if i >= len(line) {
+				return nil, nil, fmt.Errorf("unterminated double quote")
+			}
+			inWord = true
+
+		case c == '\\':
+			if i+1 >= len(line) {
+				return nil, nil, fmt.Errorf("trailing backslash")
+			}
+			i++
+			if line[i] != '\n' {
+				word.WriteByte(line[i])
+			}
+			inWord = true
+
+		case strings.IndexByte("|&;<>()", c) >= 0:
+			return nil, nil, shellOnly(string(c), "operator")
+
+		case c == '$' || c == '`':
+			return nil, nil, shellOnly(string(c), "expansion")
+
+		case c == '*' || c == '?' || c == '[':
+			return nil, nil, shellOnly(string(c), "glob")
+
+		case c == '~' && !inWord:
+			return nil, nil, shellOnly(string(c), "tilde expansion")
+
+		case c == '#' && !inWord:
+			return nil, nil, shellOnly(string(c), "comment")
+
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+
+	for len(words) > 0 && envAssignmentPattern.MatchString(words[0]) {
+		env = append(env, words[0])
+		words = words[1:]
+	}
+	if len(words) == 0 {
+		return nil, nil, fmt.Errorf("no command to run")
+	}
+	return env, words, nil
+}
+
+// shellQuote quotes s so that splitCommandLine and /bin/sh both read it
+// back as a single word
+func shellQuote(s string) string {
+	if plainWordPattern.MatchString(s) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func shellOnly(token, kind string) error {
+	return fmt.Errorf("unquoted shell %s %q needs shell: true (or quote it)", kind, token)
+}
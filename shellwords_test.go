@@ -0,0 +1,123 @@
+package main
+
+import (
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitCommandLine(t *testing.T) {
+	tests := []struct {
+		line string
+		env  []string
+		argv []string
+	}{
+		{"git pull origin main", nil, []string{"git", "pull", "origin", "main"}},
+		{"  go   build\t-o app\n", nil, []string{"go", "build", "-o", "app"}},
+		{`git commit -m "a b"`, nil, []string{"git", "commit", "-m", "a b"}},
+		{`echo 'single $HOME "quoted"'`, nil, []string{"echo", `single $HOME "quoted"`}},
+		{`echo "double 'quoted' \"escaped\" \\ \$HOME"`, nil, []string{"echo", `double 'quoted' "escaped" \ $HOME`}},
+		{`echo "keeps \n and \a"`, nil, []string{"echo", `keeps \n and \a`}},
+		{`echo a\ b \'c\'`, nil, []string{"echo", "a b", "'c'"}},
+		{`echo ab'c d'"e f"g`, nil, []string{"echo", "abc de fg"}},
+		{`echo '' ""`, nil, []string{"echo", "", ""}},
+		{"echo a\\\nb", nil, []string{"echo", "ab"}},
+		{`FOO="a b" BAR=1 ./deploy.sh --tag 'v1 final'`, []string{"FOO=a b", "BAR=1"}, []string{"./deploy.sh", "--tag", "v1 final"}},
+		{`CGO_ENABLED=0 go build -ldflags="-w -s"`, []string{"CGO_ENABLED=0"}, []string{"go", "build", "-ldflags=-w -s"}},
+		{"go build x=1", nil, []string{"go", "build", "x=1"}},
+		{`ls '*.go' "[ab]" \? a#b x=~`, nil, []string{"ls", "*.go", "[ab]", "?", "a#b", "x=~"}},
+		{`echo '|' "&&" \; '>' "<" '$(id)' '` + "`id`" + `'`, nil, []string{"echo", "|", "&&", ";", ">", "<", "$(id)", "`id`"}},
+	}
+	for _, tt := range tests {
+		env, argv, err := splitCommandLine(tt.line)
+		if err != nil {
+			t.Errorf("splitCommandLine(%q): %v", tt.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(env, tt.env) || !reflect.DeepEqual(argv, tt.argv) {
+			t.Errorf("splitCommandLine(%q) = %q %q, want %q %q", tt.line, env, argv, tt.env, tt.argv)
+		}
+	}
+}
+
+func TestSplitCommandLineRejects(t *testing.T) {
+	tests := []struct {
+		line    string
+		wantErr string
+	}{
+		{"docker stop app || true", `shell operator "|"`},
+		{"ps aux | grep app", `shell operator "|"`},
+		{"make && make install", `shell operator "&"`},
+		{"sleep 10 &", `shell operator "&"`},
+		{"cd app; make", `shell operator ";"`},
+		{"echo hi > out.txt", `shell operator ">"`},
+		{"echo hi >> out.txt", `shell operator ">"`},
+		{"mysql < dump.sql", `shell operator "<"`},
+		{"(cd app)", `shell operator "("`},
+		{"echo $(id)", `shell expansion "$"`},
+		{"echo $HOME", `shell expansion "$"`},
+		{`echo "$HOME"`, `shell expansion "$"`},
+		{"echo `id`", "shell expansion \"`\""},
+		{"echo \"`id`\"", "shell expansion \"`\""},
+		{"rm -rf build/*", `shell glob "*"`},
+		{"ls file?.txt", `shell glob "?"`},
+		{"ls [ab].txt", `shell glob "["`},
+		{"cd ~/app", `shell tilde expansion "~"`},
+		{"make # build it", `shell comment "#"`},
+		{"echo 'unterminated", "unterminated single quote"},
+		{`echo "unterminated`, "unterminated double quote"},
+		{`echo trailing\`, "trailing backslash"},
+		{"", "no command to run"},
+		{"   ", "no command to run"},
+		{"FOO=1 BAR=2", "no command to run"},
+	}
+	for _, tt := range tests {
+		_, _, err := splitCommandLine(tt.line)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("splitCommandLine(%q) error = %v, want one containing %q", tt.line, err, tt.wantErr)
+		}
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	words := []string{
+		"plain",
+		"ghcr.io/company/api:1.4.2",
+		"KEY=value",
+		"",
+		"a b",
+		"it's",
+		`"double" \back`,
+		"$(id) `id` $HOME",
+		"a|b;c&&d>e<f",
+		"*?[~#",
+		"new\nline",
+	}
+	for _, word := range words {
+		quoted := shellQuote(word)
+		_, argv, err := splitCommandLine("echo " + quoted)
+		if err != nil || len(argv) != 2 || argv[1] != word {
+			t.Errorf("shellQuote(%q) = %s, read back as %q (%v)", word, quoted, argv, err)
+		}
+	}
+	if got := shellQuote("ghcr.io/company/api:1.4.2"); got != "ghcr.io/company/api:1.4.2" {
+		t.Errorf("plain word quoted as %s", got)
+	}
+}
+
+// /bin/sh must read a quoted word back the same way splitCommandLine does
+func TestShellQuoteWithShell(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh")
+	}
+	for _, word := range []string{"a b", "it's", "$(id) `id` $HOME", "a|b;c", "*", "", "~"} {
+		out, err := exec.Command("sh", "-c", "printf %s "+shellQuote(word)).Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != word {
+			t.Errorf("sh read shellQuote(%q) back as %q", word, out)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// inflightTracker keeps track of the background work started by webhooks so
+// shutdown can wait for it instead of killing a deployment halfway.
+type inflightTracker struct {
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+	nextID   int
+	tasks    map[int]*inflightTask
+	draining bool
+}
+
+type inflightTask struct {
+	Name    string
+	Phase   string
+	Started time.Time
+}
+
+var inflight = &inflightTracker{tasks: make(map[int]*inflightTask)}
+
+// abandonCtx is cancelled when the shutdown grace period runs out. Running
+// deployments are derived from it, so their commands and process groups are
+// killed before the process exits.
+var abandonCtx, abandonRunning = context.WithCancel(context.Background())
+
+// shutdownStarted is closed when the server begins shutting down, so
+// long-lived requests such as log streams let go of their connection.
+var shutdownStarted = make(chan struct{})
+
+// start registers a task. It returns false once shutdown has begun, in which
+// case the caller must not start the work.
+func (t *inflightTracker) start(name, phase string) (id int, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.draining {
+		return 0, false
+	}
+	t.nextID++
+	t.tasks[t.nextID] = &inflightTask{Name: name, Phase: phase, Started: time.Now()}
+	t.wg.Add(1)
+	return t.nextID, true
+}
+
+func (t *inflightTracker) setPhase(id int, phase string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if task, ok := t.tasks[id]; ok {
+		task.Phase = phase
+	}
+}
+
+func (t *inflightTracker) done(id int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.tasks[id]; ok {
+		delete(t.tasks, id)
+		t.wg.Done()
+	}
+}
+
+// drain stops new tasks from starting and waits up to grace for the running
+// ones. It returns a description of every task that was still running.
+func (t *inflightTracker) drain(grace time.Duration) []string {
+	t.mu.Lock()
+	t.draining = true
+	t.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-time.After(grace):
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var abandoned []string
+	for _, task := range t.tasks {
+		abandoned = append(abandoned, fmt.Sprintf("%s (%s, running for %v)",
+			task.Name, task.Phase, time.Since(task.Started).Round(time.Second)))
+	}
+	sort.Strings(abandoned)
+	return abandoned
+}
+
+// serveUntilSignal runs srv until SIGTERM/SIGINT, then stops accepting
+// webhooks, drains in-flight work and exits.
+func serveUntilSignal(srv *http.Server) {
+	srv.RegisterOnShutdown(func() { close(shutdownStarted) })
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- srv.ListenAndServe()
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+
+	select {
+	case err := <-serverErr:
+		log.Fatal(err)
+	case sig := <-stop:
+		log.Printf("Received %v, shutting down", sig)
+	}
+
+	grace := getConfig().ShutdownGracePeriod
+	deadline := time.Now().Add(grace)
+
+	// Close the listener first so no new deployment can be accepted while draining
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Error stopping HTTP server: %v", err)
+	}
+
+	if queued := jobQueue.pause(); queued > 0 {
+		log.Printf("Keeping %d queued deployment(s) for the next start", queued)
+	}
+	log.Printf("Waiting up to %v for running deployments and notifications", time.Until(deadline).Round(time.Second))
+	abandoned := inflight.drain(time.Until(deadline))
+	if len(abandoned) == 0 {
+		log.Printf("Shutdown complete, nothing abandoned")
+		os.Exit(0)
+	}
+
+	log.Printf("Grace period of %v expired, abandoning %d task(s) (their jobs are re-run on the next start):", grace, len(abandoned))
+	for _, task := range abandoned {
+		log.Printf("  - %s", task)
+	}
+
+	// Kill the commands that are still running and give them time to exit
+	abandonRunning()
+	if left := inflight.drain(killWaitDelay + time.Second); len(left) > 0 {
+		log.Printf("%d task(s) did not stop after being killed", len(left))
+	}
+	os.Exit(1)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// fileStore is a small embedded key/value store: named buckets of JSON
+// documents, one file per bucket under the data directory, so a change to
+// the queue does not rewrite the history. Every write replaces the bucket's
+// file atomically (write to a temp file, fsync, rename) so a crash never
+// leaves a half-written state behind.
+type fileStore struct {
+	mu      sync.Mutex
+	dir     string
+	buckets map[string]map[string]json.RawMessage
+}
+
+func openStore(dir string) (*fileStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	s := &fileStore{
+		dir:     dir,
+		buckets: make(map[string]map[string]json.RawMessage),
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		name := filepath.Base(file)
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		var bucket map[string]json.RawMessage
+		if err := readJSON(file, &bucket); err != nil {
+			return nil, err
+		}
+		s.buckets[strings.TrimSuffix(name, ".json")] = bucket
+	}
+	return s, nil
+}
+
+func readJSON(file string, value interface{}) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, value); err != nil {
+		return fmt.Errorf("%s is corrupt: %w", file, err)
+	}
+	return nil
+}
+
+func (s *fileStore) put(bucket, key string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.buckets[bucket] == nil {
+		s.buckets[bucket] = make(map[string]json.RawMessage)
+	}
+	s.buckets[bucket][key] = data
+	return s.flush(bucket)
+}
+
+// get decodes the value stored under key into value and reports whether it existed
+func (s *fileStore) get(bucket, key string, value interface{}) (bool, error) {
+	s.mu.Lock()
+	data, ok := s.buckets[bucket][key]
+	s.mu.Unlock()
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal(data, value)
+}
+
+func (s *fileStore) delete(bucket, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.buckets[bucket][key]; !ok {
+		return nil
+	}
+	delete(s.buckets[bucket], key)
+	return s.flush(bucket)
+}
+
+// keys returns the keys of a bucket in sorted order
+func (s *fileStore) keys(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.buckets[bucket]))
+	for k := range s.buckets[bucket] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// flush writes one bucket to its file; s.mu must be held
+func (s *fileStore) flush(bucket string) error {
+	data, err := json.Marshal(s.buckets[bucket])
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(s.dir, "."+bucket+"-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(s.dir, bucket+".json"))
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// CrashWatch keeps an eye on a new container for a while after it started,
+// so a crash loop fails the deployment instead of surfacing later
+type CrashWatch struct {
+	Window   time.Duration `yaml:"window"`    // how long to watch, e.g. 60s; 0 disables the watch
+	Interval time.Duration `yaml:"interval"`  // between inspections, default 2s
+	LogLines int           `yaml:"log_lines"` // container output attached to a failure, default 50
+}
+
+// crashReport describes a container that did not stay up
+type crashReport struct {
+	Container string `json:"container"`
+	Reason    string `json:"reason"`
+	Logs      string `json:"logs,omitempty"` // last lines of the container output
+}
+
+func (w CrashWatch) merge(over CrashWatch) CrashWatch {
+	if over.Window != 0 {
+		w.Window = over.Window
+	}
+	if over.Interval != 0 {
+		w.Interval = over.Interval
+	}
+	if over.LogLines != 0 {
+		w.LogLines = over.LogLines
+	}
+	return w
+}
+
+// validate reports the mistakes in a (possibly partial) watch section
+func (w CrashWatch) validate(where string) []error {
+	if w.Window < 0 || w.Interval < 0 || w.LogLines < 0 {
+		return []error{fmt.Errorf("%s: window, interval and log_lines must not be negative", where)}
+	}
+	return nil
+}
+
+// watchStep watches the container named by container() for the window of
+// w. A container that exits, restarts or turns unhealthy fails the step; its
+// last log lines are passed to run.onCrash for the notification.
+func watchStep(host string, w CrashWatch, name string, container func() string) Step {
+	if w.Interval == 0 {
+		w.Interval = 2 * time.Second
+	}
+	if w.LogLines == 0 {
+		w.LogLines = 50
+	}
+	watch := func(ctx context.Context, out io.Writer, run *deployRun) error {
+		c, err := dockerClientFor(host)
+		if err != nil {
+			return err
+		}
+		name := container()
+		reason, err := w.watch(ctx, c, name, out)
+		if err != nil || reason == "" {
+			return err
+		}
+
+		report := crashReport{Container: name, Reason: reason}
+		if logs, err := c.containerLogs(ctx, name, w.LogLines); err != nil {
+			fmt.Fprintf(out, "Cannot read the logs of %s: %v\n", name, err)
+		} else if report.Logs = strings.TrimRight(logs, "\n"); report.Logs != "" {
+			fmt.Fprintf(out, "Last log lines of %s:\n%s\n", name, report.Logs)
+		}
+		if run.onCrash != nil {
+			run.onCrash(report)
+		}
+		return fmt.Errorf("%s %s", name, reason)
+	}
+	return Step{Run: fmt.Sprintf("watch %s for %v", name, w.Window), call: watch}
+}
+
+// watch inspects the container until the window is over. It returns why the
+// container did not stay up, "" when it did.
+func (w CrashWatch) watch(ctx context.Context, c *dockerClient, name string, out io.Writer) (string, error) {
+	first, err := c.inspectContainer(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprintf(out, "Watching %s for %v\n", name, w.Window)
+	window := time.NewTimer(w.Window)
+	defer window.Stop()
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+
+	container := first
+	for {
+		if reason := crashReason(first, container); reason != "" {
+			return reason, nil
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-window.C:
+			health := ""
+			if h := container.State.Health; h != nil {
+				health = ", " + h.Status
+			}
+			fmt.Fprintf(out, "%s stayed up for %v (%s%s)\n", name, w.Window, container.State.Status, health)
+			return "", nil
+		case <-ticker.C:
+		}
+		if container, err = c.inspectContainer(ctx, name); err != nil {
+			return "", err
+		}
+	}
+}
+
+// crashReason compares the container with its state when the watch began
+func crashReason(first, now dockerContainer) string {
+	state := now.State
+	exit := fmt.Sprintf("exit code %d", state.ExitCode)
+	if state.OOMKilled {
+		exit += ", out of memory"
+	}
+	switch {
+	case now.RestartCount > first.RestartCount:
+		return fmt.Sprintf("restarted %d time(s) (last %s)", now.RestartCount-first.RestartCount, exit)
+	case state.Restarting:
+		return fmt.Sprintf("is restarting (%s)", exit)
+	case !state.Running:
+		return fmt.Sprintf("is %s (%s)", state.Status, exit)
+	case state.Health != nil && state.Health.Status == "unhealthy":
+		return "is unhealthy according to its HEALTHCHECK"
+	}
+	return ""
+}